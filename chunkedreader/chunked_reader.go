@@ -5,6 +5,8 @@ import (
 	"bytes"
 	"errors"
 	"io"
+
+	"github.com/arthur-teixeira/go-http/textreader"
 )
 
 type ChunkedReader struct {
@@ -13,9 +15,10 @@ type ChunkedReader struct {
 	err      error
 	n        uint64
 	checkEnd bool
+	trailer  map[string][]string
 }
 
-func NewChunkedReader(rdr io.Reader) io.Reader {
+func NewChunkedReader(rdr io.Reader) *ChunkedReader {
 	r, ok := rdr.(*bufio.Reader)
 	if !ok {
 		r = bufio.NewReader(rdr)
@@ -110,10 +113,40 @@ func (c *ChunkedReader) beginChunk() {
 	}
 
 	if c.n == 0 {
+		c.readTrailer()
+	}
+}
+
+const maxTrailerBytes = 64 << 10
+
+// Reads the trailer section after the last chunk, up to the empty line that
+// ends the message. See RFC 9112, 7.1.2.
+func (c *ChunkedReader) readTrailer() {
+	tr := textreader.NewTextReader(c.rdr)
+	defer textreader.PutTextReader(tr)
+
+	tr.MaxLineLength = maxLineLength
+	tr.MaxHeaderBytes = maxTrailerBytes
+	trailer, err := tr.ReadHeaders()
+	switch {
+	case err == io.EOF:
+		c.err = io.ErrUnexpectedEOF
+	case err != nil:
+		c.err = err
+	default:
+		if len(trailer) > 0 {
+			c.trailer = trailer
+		}
 		c.err = io.EOF
 	}
 }
 
+// Returns the trailer fields sent after the last chunk. Only set once the
+// body was read until io.EOF.
+func (c *ChunkedReader) Trailer() map[string][]string {
+	return c.trailer
+}
+
 func parseUint(line []byte) (uint64, error) {
 	if len(line) == 0 {
 		return 0, errors.New("Empty hex for chunk length")
@@ -0,0 +1,149 @@
+package chunkedreader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var ErrWriterClosed = errors.New("chunked writer is closed")
+
+// Encodes a body with the chunked transfer coding, see RFC 9112, 7.1.
+// Nothing is written for the body as a whole, only its chunks, so w has to
+// be positioned right after the headers of the message.
+type ChunkedWriter struct {
+	w io.Writer
+	// Max size of a chunk. Writes are buffered until a full chunk is
+	// available or Flush is called. Zero sends each Write as its own chunk.
+	ChunkSize int
+	// Sent after the size of every chunk, e.g. "name=value"
+	Extension string
+	// Fields sent after the last chunk by Close. Announcing them in a
+	// Trailer header is up to the caller.
+	Trailer map[string][]string
+	buf     []byte
+	closed  bool
+}
+
+func NewChunkedWriter(w io.Writer) *ChunkedWriter {
+	return &ChunkedWriter{w: w}
+}
+
+func (c *ChunkedWriter) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, ErrWriterClosed
+	}
+
+	if c.ChunkSize <= 0 {
+		if err := c.writeChunk(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		if len(c.buf) == 0 && len(p) >= c.ChunkSize {
+			// Full chunk, no need to copy it
+			if err := c.writeChunk(p[:c.ChunkSize]); err != nil {
+				return n - len(p), err
+			}
+			p = p[c.ChunkSize:]
+			continue
+		}
+
+		m := min(c.ChunkSize-len(c.buf), len(p))
+		c.buf = append(c.buf, p[:m]...)
+		p = p[m:]
+		if len(c.buf) == c.ChunkSize {
+			if err := c.writeChunk(c.buf); err != nil {
+				return n - len(p), err
+			}
+			c.buf = c.buf[:0]
+		}
+	}
+
+	return n, nil
+}
+
+// Sends the buffered data as a chunk, and flushes the underlying writer if
+// it can be flushed.
+func (c *ChunkedWriter) Flush() error {
+	if c.closed {
+		return ErrWriterClosed
+	}
+
+	if err := c.flushBuf(); err != nil {
+		return err
+	}
+
+	if f, ok := c.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+
+	return nil
+}
+
+// Writes the buffered data, the last chunk and the trailer section, ending
+// the body. The underlying writer is neither flushed nor closed.
+func (c *ChunkedWriter) Close() error {
+	if c.closed {
+		return nil
+	}
+
+	if err := c.flushBuf(); err != nil {
+		return err
+	}
+	c.closed = true
+
+	var sb strings.Builder
+	sb.WriteString("0\r\n")
+	for k, vv := range c.Trailer {
+		for _, v := range vv {
+			sb.WriteString(k)
+			sb.WriteString(": ")
+			sb.WriteString(v)
+			sb.WriteString("\r\n")
+		}
+	}
+	sb.WriteString("\r\n")
+
+	_, err := io.WriteString(c.w, sb.String())
+	return err
+}
+
+func (c *ChunkedWriter) flushBuf() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+
+	err := c.writeChunk(c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
+
+// Writes p as a single chunk. Empty chunks are skipped, as a chunk of size
+// zero ends the body.
+func (c *ChunkedWriter) writeChunk(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	var err error
+	if c.Extension != "" {
+		_, err = fmt.Fprintf(c.w, "%x;%s\r\n", len(p), c.Extension)
+	} else {
+		_, err = fmt.Fprintf(c.w, "%x\r\n", len(p))
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.w.Write(p); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(c.w, "\r\n")
+	return err
+}
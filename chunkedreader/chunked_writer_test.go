@@ -0,0 +1,38 @@
+package chunkedreader_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/arthur-teixeira/go-http/chunkedreader"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	cw := chunkedreader.NewChunkedWriter(&buf)
+	cw.ChunkSize = 4
+	cw.Extension = "a=b"
+	cw.Trailer = map[string][]string{"Checksum": {"abc"}}
+
+	cw.Write([]byte("hello"))
+	cw.Write([]byte(" wo"))
+	assert.Equal(t, "4;a=b\r\nhell\r\n4;a=b\r\no wo\r\n", buf.String())
+
+	cw.Write([]byte("rld"))
+	assert.Nil(t, cw.Flush())
+	assert.Nil(t, cw.Close())
+	assert.Equal(t, "4;a=b\r\nhell\r\n4;a=b\r\no wo\r\n3;a=b\r\nrld\r\n0\r\nChecksum: abc\r\n\r\n", buf.String())
+
+	_, err := cw.Write([]byte("late"))
+	assert.ErrorIs(t, err, chunkedreader.ErrWriterClosed)
+
+	// The reader decodes what the writer encodes
+	cr := chunkedreader.NewChunkedReader(bufio.NewReader(&buf))
+	body, err := io.ReadAll(cr)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(body))
+	assert.Equal(t, map[string][]string{"Checksum": {"abc"}}, cr.Trailer())
+}
@@ -0,0 +1,437 @@
+package context_test
+
+import (
+	"bufio"
+	gocontext "context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arthur-teixeira/go-http/context"
+	"github.com/arthur-teixeira/go-http/parser"
+	"github.com/arthur-teixeira/go-http/status"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRequest(t *testing.T, method, rawURL string, body io.Reader) *parser.Request {
+	u, err := url.ParseRequestURI(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &parser.Request{
+		Method:  method,
+		URL:     u,
+		Headers: make(parser.Headers),
+		Body:    body,
+	}
+}
+
+func TestClientExpectContinue(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			if c.Request.URL.Path == "/reject" {
+				c.WriteHeader(status.RequestEntityTooLarge)
+				return
+			}
+			body, _ := io.ReadAll(c.Request.Body)
+			c.WriteString("got " + string(body))
+		}),
+	})
+	client := context.Client{ExpectContinueTimeout: 5 * time.Second}
+
+	res, err := client.Do(newRequest(t, "POST", "http://"+addr+"/", strings.NewReader("payload")))
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "got payload", string(body))
+
+	// The final status arrives without the client waiting for the timeout
+	start := time.Now()
+	res, err = client.Do(newRequest(t, "POST", "http://"+addr+"/reject", strings.NewReader("payload")))
+	assert.Nil(t, err)
+	assert.Equal(t, status.RequestEntityTooLarge, res.StatusCode)
+	assert.True(t, res.Close)
+	assert.Less(t, time.Since(start), time.Second)
+	res.Body.Close()
+}
+
+func TestClientInterimResponse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+
+		// Both responses arrive in the same read
+		conn.Write([]byte("HTTP/1.1 103 Early Hints\r\nLink: </style.css>\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"))
+		io.Copy(io.Discard, br)
+	}()
+
+	client := context.Client{Timeout: 2 * time.Second}
+	res, err := client.Do(newRequest(t, "GET", "http://"+l.Addr().String()+"/", nil))
+	if !assert.Nil(t, err) {
+		return
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, status.OK, res.StatusCode)
+	assert.Equal(t, "ok", string(body))
+}
+
+func TestClientRedirectReplaysBody(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			if c.Request.URL.Path == "/old" {
+				c.Response.Headers.Set("Location", "/new")
+				c.WriteHeader(status.TemporaryRedirect)
+				return
+			}
+			body, _ := io.ReadAll(c.Request.Body)
+			c.WriteString(c.Request.Method + " got=" + string(body))
+		}),
+	})
+
+	// The body is sent again to the new location
+	req := newRequest(t, "POST", "http://"+addr+"/old", strings.NewReader("body"))
+	req.ReadBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("body")), nil
+	}
+	res, err := (&context.Client{}).Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "POST got=body", string(body))
+}
+
+func TestClientChunkedUpload(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			body, _ := io.ReadAll(c.Request.Body)
+			c.WriteString(fmt.Sprintf("chunked=%t got %s trailer=%s",
+				c.Request.Chunked, body, c.Request.Trailer.Get("Checksum")))
+		}),
+	})
+	client := context.Client{}
+
+	do := func(req *parser.Request) string {
+		res, err := client.Do(req)
+		assert.Nil(t, err)
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return string(body)
+	}
+
+	stream := func(parts ...string) io.Reader {
+		pr, pw := io.Pipe()
+		go func() {
+			for _, p := range parts {
+				pw.Write([]byte(p))
+			}
+			pw.Close()
+		}()
+		return pr
+	}
+
+	req := newRequest(t, "POST", "http://"+addr+"/", stream("streamed ", "body"))
+	req.ContentLength = -1
+	assert.Equal(t, "chunked=true got streamed body trailer=", do(req))
+
+	// Readers of unknown size are sent chunked without setting the length
+	req = newRequest(t, "POST", "http://"+addr+"/", stream("unsized"))
+	assert.Equal(t, "chunked=true got unsized trailer=", do(req))
+
+	req = newRequest(t, "POST", "http://"+addr+"/", stream())
+	assert.Equal(t, "chunked=false got  trailer=", do(req))
+
+	// Trailer values are sent once the body is written
+	req = newRequest(t, "POST", "http://"+addr+"/", strings.NewReader("with trailer"))
+	req.Trailer = parser.Headers{"Checksum": nil}
+	req.Body = io.TeeReader(req.Body, writerFunc(func(p []byte) (int, error) {
+		req.Trailer.Set("Checksum", "abc")
+		return len(p), nil
+	}))
+	assert.Equal(t, "chunked=true got with trailer trailer=abc", do(req))
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestClientEarlyResponse(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		MaxBodyBytes: 1 << 10,
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			body, _ := io.ReadAll(c.Request.Body)
+			c.WriteString("got " + string(body))
+		}),
+	})
+	client := context.Client{}
+
+	// The server rejects the body after reading a part of it, and stops
+	// reading while the client is still writing
+	req := newRequest(t, "POST", "http://"+addr+"/", strings.NewReader(strings.Repeat("x", 16<<20)))
+	res, err := client.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, status.RequestEntityTooLarge, res.StatusCode)
+	assert.True(t, res.Close)
+	res.Body.Close()
+
+	req = newRequest(t, "POST", "http://"+addr+"/", strings.NewReader("small"))
+	res, err = client.Do(req)
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "got small", string(body))
+}
+
+func TestClientContextCancel(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	addr := startServer(t, &context.Server{
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			if c.Request.URL.Path == "/body" {
+				c.WriteString("partial")
+				c.Flush()
+			}
+			<-release
+		}),
+	})
+	client := context.Client{}
+
+	// Canceled while waiting for the response headers
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req, _ := parser.NewRequestWithContext(ctx, "GET", "http://"+addr+"/", nil)
+	start := time.Now()
+	_, err := client.Do(req)
+	assert.ErrorIs(t, err, gocontext.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Deadline passes while reading the body
+	ctx, cancel = gocontext.WithTimeout(gocontext.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ = parser.NewRequestWithContext(ctx, "GET", "http://"+addr+"/body", nil)
+	res, err := client.Do(req)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(res.Body)
+	assert.ErrorIs(t, err, gocontext.DeadlineExceeded)
+	res.Body.Close()
+
+	// Client.Timeout applies the same way
+	client.Timeout = 50 * time.Millisecond
+	_, err = client.Do(newRequest(t, "GET", "http://"+addr+"/", nil))
+	assert.ErrorIs(t, err, gocontext.DeadlineExceeded)
+}
+
+// Serves a raw server that answers the first request on every connection,
+// and closes the connection as soon as the second one arrives.
+func startFlakyServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			n := conns.Add(1)
+
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for i := 0; i < 2; i++ {
+					for {
+						line, err := br.ReadString('\n')
+						if err != nil {
+							return
+						}
+						if line == "\r\n" {
+							break
+						}
+					}
+					if i == 1 {
+						return
+					}
+					fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nconn-%d", n)
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestClientRetriesReusedConnection(t *testing.T) {
+	addr := startFlakyServer(t)
+	client := context.Client{}
+
+	get := func(method string, body io.Reader) (string, error) {
+		req, _ := parser.NewRequest(method, "http://"+addr+"/", body)
+		if method == "POST" {
+			// Not replayable
+			req.ReadBody = nil
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		return string(b), err
+	}
+
+	body, err := get("GET", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "conn-1", body)
+
+	// The pooled connection looks alive, but the server closes it as the
+	// request arrives. The request is sent again on a new connection.
+	body, err = get("GET", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "conn-2", body)
+
+	// Requests that aren't idempotent aren't retried
+	_, err = get("POST", strings.NewReader("data"))
+	assert.NotNil(t, err)
+}
+
+func TestClientSkipsClosedConnection(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		IdleTimeout: 20 * time.Millisecond,
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			c.WriteString("ok")
+		}),
+	})
+	client := context.Client{}
+
+	for range 2 {
+		res, err := client.Do(newRequest(t, "POST", "http://"+addr+"/", strings.NewReader("body")))
+		assert.Nil(t, err)
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "ok", string(body))
+
+		// The server closes the pooled connection in the meantime
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestClientDrainsClosedBody(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					reqLine, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					for {
+						line, err := br.ReadString('\n')
+						if err != nil {
+							return
+						}
+						if line == "\r\n" {
+							break
+						}
+					}
+
+					if strings.Contains(reqLine, "/stall") {
+						// The rest of the body never comes
+						conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nhello"))
+						continue
+					}
+					conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nhello world"))
+				}
+			}()
+		}
+	}()
+
+	client := context.Client{}
+	get := func(path string) {
+		res, err := client.Do(newRequest(t, "GET", "http://"+l.Addr().String()+path, nil))
+		assert.Nil(t, err)
+		buf := make([]byte, 1)
+		res.Body.Read(buf)
+		assert.Nil(t, res.Body.Close())
+		assert.Nil(t, res.Body.Close())
+	}
+
+	// The rest of the body is read, so the connection is reused
+	get("/")
+	get("/")
+	assert.Equal(t, int32(1), conns.Load())
+
+	// Draining gives up on a body that doesn't come
+	start := time.Now()
+	get("/stall")
+	assert.Less(t, time.Since(start), time.Second)
+	get("/")
+	assert.Equal(t, int32(2), conns.Load())
+}
+
+func TestClientExtensionMethod(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			body, _ := io.ReadAll(c.Request.Body)
+			c.WriteString(c.Request.Method + " " + string(body))
+		}),
+	})
+	client := context.Client{}
+
+	req, err := parser.NewRequest("PATCH", "http://"+addr+"/", strings.NewReader("changes"))
+	assert.Nil(t, err)
+	res, err := client.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "PATCH changes", string(body))
+
+	_, err = client.Do(newRequest(t, "BAD METHOD", "http://"+addr+"/", nil))
+	assert.NotNil(t, err)
+}
@@ -3,6 +3,7 @@ package context
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
@@ -11,34 +12,33 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 	"unicode"
 
+	"github.com/arthur-teixeira/go-http/chunkedreader"
 	"github.com/arthur-teixeira/go-http/parser"
 	"github.com/arthur-teixeira/go-http/status"
 	"github.com/arthur-teixeira/go-http/transport"
 	"golang.org/x/net/idna"
 )
 
-type ResponseWriter struct {
-	bw         *bufio.Writer
-	status     int
-	Headers    parser.Headers
-	contentLen int
-}
-
-func NewWriter(bw *bufio.Writer) ResponseWriter {
-	return ResponseWriter{bw: bw}
+type Context struct {
+	Request  *parser.Request
+	Response ResponseWriter
+	Params   Params // Set by the Router for routes with :param or *wildcard segments
+	handlers chain  // Middleware chain currently running, see Next
+	index    int
+	aborted  bool
 }
 
-type Context struct {
-	Request     *parser.Request
-	Response    ResponseWriter
-	wroteHeader bool
+// Value of the path parameter captured by the matched route, or "" if it
+// doesn't exist
+func (c *Context) Param(key string) string {
+	return c.Params.ByName(key)
 }
 
 func (c *Context) Status(code int) {
@@ -47,6 +47,11 @@ func (c *Context) Status(code int) {
 
 // Copied from https://github.com/gin-gonic/gin/blob/master/context.go#L985
 func (c *Context) Header(key, value string) {
+	if c.Response.wroteHeader {
+		log.Printf("[WARNING]: Headers were already written. Tried to set %s", key)
+		return
+	}
+
 	if value == "" {
 		c.Response.Headers.Del(key)
 		return
@@ -54,17 +59,10 @@ func (c *Context) Header(key, value string) {
 	c.Response.Headers.Set(key, value)
 }
 
-// Writes the response Status Line e.g: HTTP/1.1 200 OK
+// Commits the response status code. The status line is sent along with the
+// headers, see ResponseWriter.
 func (c *Context) WriteHeader(code int) {
-	if c.wroteHeader {
-		log.Printf("[WARNING]: Header was already written. Tried to overwrite %d with %d", c.Response.status, code)
-		return
-	}
-
-	c.Status(code)
-	c.writeStatusLine()
-	c.Response.bw.Flush()
-	c.wroteHeader = true
+	c.Response.WriteHeader(code)
 }
 
 func writeHeaders(req *parser.Request, bw *bufio.Writer, contentLen int, hdrs parser.Headers) (int, error) {
@@ -133,90 +131,45 @@ func writeHeaders(req *parser.Request, bw *bufio.Writer, contentLen int, hdrs pa
 	return written + n, nil
 }
 
-// Writes the response headers to the underlying connection
-func (c *Context) writeHeaders() (int, error) {
-	return writeHeaders(c.Request, c.Response.bw, c.Response.contentLen, c.Request.Headers)
-}
-
 func (c *Context) Write(data []byte) (int, error) {
-	c.Response.contentLen = len(data)
-	fmt.Println("Content length is", c.Response.contentLen)
-	if !c.wroteHeader {
-		c.WriteHeader(status.OK) // Following Go default behavior
-	}
-
-	written := 0
-	n, err := c.writeHeaders()
-	if err != nil {
-		return -1, err
-	}
-	written += n
-
-	n, err = c.Response.bw.Write(data)
-	if err != nil {
-		return -1, err
-	}
-	written += n
-	err = c.Response.bw.Flush()
-	if err != nil {
-		return -1, err
-	}
-
-	return written, nil
+	return c.Response.Write(data)
 }
 
 func (c *Context) WriteString(data string) (int, error) {
-	return c.Write([]byte(data))
+	return c.Response.Write([]byte(data))
 }
 
-func (c *Context) writeStatusLine() {
-	code := c.Response.status
-
-	if c.Request.ProtoAtLeast(1, 1) {
-		c.Response.bw.WriteString("HTTP/1.1 ")
-	} else {
-		c.Response.bw.WriteString("HTTP/1.0 ")
-	}
+// Sends everything written so far to the client, see ResponseWriter.Flush
+func (c *Context) Flush() error {
+	return c.Response.Flush()
+}
 
-	if text := status.Text(code); text != "" {
-		c.Response.bw.WriteString(strconv.Itoa(code))
-		c.Response.bw.WriteByte(' ')
-		c.Response.bw.WriteString(text)
-		c.Response.bw.WriteString("\r\n")
-	} else {
-		fmt.Fprintf(c.Response.bw, "%03d status code %d\r\n", code, code)
-	}
+// Completes the response after the handler returns, sending the status line
+// and headers in case the handler didn't write them.
+func (c *Context) finish() error {
+	return c.Response.finish()
 }
 
 func NewContext(conn net.Conn) (*Context, error) {
-	b := bufio.NewReader(conn)
-	bw := bufio.NewWriter(conn)
-  req, err := parser.ParseRequest(b, nil) // TODO: connection from manager
+	return newContext(bufio.NewReader(conn), bufio.NewWriter(conn), parser.RequestOptions{})
+}
+
+// Reads the next request from b. The server keeps b across requests of a
+// persistent connection so that no buffered bytes are lost between them.
+func newContext(b *bufio.Reader, bw *bufio.Writer, opts parser.RequestOptions) (*Context, error) {
+	req, err := parser.ParseRequestOptions(b, nil, opts) // TODO: connection from manager
 	if err != nil {
 		return nil, err
 	}
 
 	return &Context{
-		Request: req,
-		Response: ResponseWriter{
-			bw:     bw,
-			status: 0,
-		},
+		Request:  req,
+		Response: NewWriter(bw, req),
 	}, nil
 }
 
 func validateMethod(method string) error {
-	switch method {
-	case "OPTIONS":
-	case "GET":
-	case "HEAD":
-	case "POST":
-	case "PUT":
-	case "DELETE":
-	case "TRACE":
-	case "CONNECT":
-		return nil
-	default:
+	if !parser.ValidMethod(method) {
 		return errors.New("http: invalid method")
 	}
 
@@ -235,10 +188,19 @@ func writeRequestLine(wtr *bufio.Writer, req *parser.Request) error {
 }
 
 type Client struct {
-	Timeout   time.Duration
-	transport *transport.ConnectionManager
+	Timeout time.Duration
+	// Time to wait for a 100 Continue from the server before sending a
+	// request body anyway. When set, requests with a body are sent with
+	// Expect: 100-continue. Zero sends the body right away, unless the
+	// request sets the Expect header itself.
+	ExpectContinueTimeout time.Duration
+	transport             *transport.ConnectionManager
 }
 
+// Used for requests that set Expect: 100-continue themselves when the
+// client has no ExpectContinueTimeout
+const defaultExpectContinueTimeout = time.Second
+
 func (c *Client) Transport() *transport.ConnectionManager {
 	if c.transport == nil {
 		return &transport.Manager
@@ -247,6 +209,11 @@ func (c *Client) Transport() *transport.ConnectionManager {
 	return c.transport
 }
 
+// Closes the pooled connections that aren't in use
+func (c *Client) CloseIdleConnections() {
+	c.Transport().CloseIdleConnections()
+}
+
 func (c *Client) deadline() time.Time {
 	if c.Timeout > 0 {
 		return time.Now().Add(c.Timeout)
@@ -261,11 +228,14 @@ func (c *Client) Do(req *parser.Request) (*parser.Response, error) {
 	if req.URL == nil {
 		return nil, errors.New("http: nil URL")
 	}
+	if req.Headers == nil {
+		req.Headers = make(parser.Headers)
+	}
 	var (
 		deadline       = c.deadline()
 		reqs           []*parser.Request
 		res            *parser.Response
-		includeBody    bool
+		includeBody    = true
 		redirectMethod string
 	)
 
@@ -293,7 +263,11 @@ func (c *Client) Do(req *parser.Request) (*parser.Response, error) {
 			}
 
 			initialReq := reqs[0]
+			// Frees the connection of the previous hop
+			res.Body.Close()
+
 			req = &parser.Request{
+				Ctx:     initialReq.Ctx,
 				Method:  redirectMethod,
 				URL:     url,
 				Headers: make(parser.Headers),
@@ -314,18 +288,10 @@ func (c *Client) Do(req *parser.Request) (*parser.Response, error) {
 			}
 		}
 
-		var cancel context.CancelFunc
-		ctx := context.Background()
-		if c.Timeout > 0 {
-			ctx, cancel = context.WithTimeout(ctx, c.Timeout)
-			defer cancel()
-		}
-
 		reqs = append(reqs, req)
 		var err error
-		var didTimeout func() bool
-		if res, didTimeout, err = send(c.Transport(), req, deadline); err != nil {
-			if !deadline.IsZero() && didTimeout() {
+		if res, err = send(c.Transport(), req, deadline, c.ExpectContinueTimeout); err != nil {
+			if !deadline.IsZero() && errors.Is(err, context.DeadlineExceeded) {
 				err = fmt.Errorf("%w (Timeout exceeded while waiting for headers)", err)
 			}
 			return nil, err
@@ -339,8 +305,8 @@ func (c *Client) Do(req *parser.Request) (*parser.Response, error) {
 		if !shouldRedirect {
 			return res, nil
 		} else {
-      fmt.Println("Redirection")
-    }
+			fmt.Println("Redirection")
+		}
 
 		if !includeBodyOnHop {
 			includeBody = false
@@ -361,46 +327,81 @@ func copyHeaders(initialReq *parser.Request, req *parser.Request, stripSensitive
 	}
 }
 
-func nop()              {}
-func alwaysFalse() bool { return false }
-
-func setRequestCancel(req *parser.Request, deadline time.Time) (func(), func() bool) {
+// Returns the context a request is sent with. It's also done once the
+// client deadline passes or req.Cancel is closed. stop releases it.
+func setRequestCancel(req *parser.Request, deadline time.Time) (ctx context.Context, stop func()) {
 	if deadline.IsZero() {
-		return nop, alwaysFalse
+		ctx, stop = context.WithCancel(req.Context())
+	} else {
+		ctx, stop = context.WithDeadline(req.Context(), deadline)
 	}
 
-	oldCtx := req.Context()
-	var cancelCtx func()
-	req.Ctx, cancelCtx = context.WithDeadline(oldCtx, deadline)
-	cancel := make(chan struct{})
-	req.Cancel = cancel
+	if req.Cancel != nil {
+		go func() {
+			select {
+			case <-req.Cancel:
+				stop()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	return ctx, stop
+}
 
-	doCancel := func() {
-		close(cancel)
+// Makes errors caused by the context being done match its error
+func ctxErr(ctx context.Context, err error) error {
+	if cerr := ctx.Err(); cerr != nil && !errors.Is(err, cerr) {
+		return fmt.Errorf("%w: %w", cerr, err)
 	}
 
-	stopTimerCh := make(chan struct{})
-	stopTimer := sync.OnceFunc(func() {
-		close(stopTimerCh)
-		if cancelCtx != nil {
-			cancelCtx()
-		}
-	})
+	return err
+}
 
-	timer := time.NewTimer(time.Until(deadline))
-	var didTimeout atomic.Bool
+// A deadline in the past, which interrupts pending I/O right away
+var aLongTimeAgo = time.Unix(1, 0)
 
-	go func() {
-		select {
-		case <-timer.C:
-			didTimeout.Store(true)
-			doCancel()
-		case <-stopTimerCh:
-			timer.Stop()
-		}
-	}()
+// Connection of a single request, interrupted and closed once the context
+// of the request is done. It's only returned to the pool if that didn't
+// happen.
+type ctxConn struct {
+	deadlineConn
+	stop  func() bool
+	nread int // Bytes of the response read so far
+}
+
+func (c *ctxConn) Read(p []byte) (int, error) {
+	n, err := c.deadlineConn.Read(p)
+	c.nread += n
+	return n, err
+}
+
+func watchConn(ctx context.Context, c deadlineConn) *ctxConn {
+	return &ctxConn{
+		deadlineConn: c,
+		stop: context.AfterFunc(ctx, func() {
+			c.SetDeadline(aLongTimeAgo)
+			c.Close()
+		}),
+	}
+}
+
+func (c *ctxConn) Release() {
+	if c.stop() {
+		c.deadlineConn.Release()
+	}
+}
 
-	return stopTimer, didTimeout.Load
+// Whether req can be sent again after a failure. Its method must be
+// idempotent, see RFC 9110, 9.2.2, and its body must be replayable.
+func canRetry(req *parser.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+	default:
+		return false
+	}
+
+	return req.Body == nil || req.Body == parser.NoBody || req.ReadBody != nil
 }
 
 var portMap = map[string]string{
@@ -442,18 +443,208 @@ func canonicalAddr(url *url.URL) string {
 	return net.JoinHostPort(idnaASCIIFromURL(url), port)
 }
 
-func send(transport *transport.ConnectionManager, req *parser.Request, deadline time.Time) (*parser.Response, func() bool, error) {
-	stopTimer, didTimeout := setRequestCancel(req, deadline)
-	sock, err := transport.GetConnection(canonicalAddr(req.URL))
+// Reads the first byte of a body whose length wasn't given, telling an
+// empty body apart from one of unknown length.
+func probeBody(body io.Reader) (io.Reader, int64, error) {
+	var b [1]byte
+	n, err := io.ReadFull(body, b[:])
+	if err == io.EOF {
+		return parser.NoBody, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return io.MultiReader(bytes.NewReader(b[:n]), body), -1, nil
+}
 
+// Announces the names of the trailer fields sent after the body
+func writeTrailerHeader(bw *bufio.Writer, trailer parser.Headers) error {
+	if len(trailer) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(trailer))
+	for k := range trailer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	_, err := bw.WriteString("Trailer: " + strings.Join(keys, ", ") + "\r\n")
+	return err
+}
+
+// Writes the request body from body, in chunks when its length is unknown
+func writeBody(bw *bufio.Writer, req *parser.Request, body io.Reader, chunked bool) error {
+	if chunked {
+		cw := chunkedreader.NewChunkedWriter(bw)
+		if _, err := io.Copy(cw, body); err != nil {
+			return err
+		}
+		// Trailer values can be set while the body is read
+		cw.Trailer = req.Trailer
+		return cw.Close()
+	}
+
+	nr, err := io.Copy(bw, io.LimitReader(body, req.ContentLength))
 	if err != nil {
-		return nil, alwaysFalse, err
+		return err
+	}
+	if nr < req.ContentLength {
+		return errors.New("http: Could not write whole body")
 	}
 
+	return nil
+}
+
+var errUploadAborted = errors.New("http: request body upload aborted")
+
+// Connection of a request whose body is written while the response is read.
+// It's only reused if the whole body was sent.
+type uploadConn struct {
+	deadlineConn
+	done    chan struct{} // Closed once writing the body stopped
+	err     error         // Why writing the body stopped, set before done is closed
+	aborted atomic.Bool
+}
+
+func (u *uploadConn) Release() {
+	select {
+	case <-u.done:
+		if u.err == nil {
+			u.deadlineConn.Release()
+			return
+		}
+	default:
+		u.aborted.Store(true)
+	}
+
+	u.deadlineConn.Close()
+}
+
+// Stops reading the body once the upload is aborted
+type abortableReader struct {
+	r       io.Reader
+	aborted *atomic.Bool
+}
+
+func (a abortableReader) Read(p []byte) (int, error) {
+	if a.aborted.Load() {
+		return 0, errUploadAborted
+	}
+
+	return a.r.Read(p)
+}
+
+// Writes the request body while reading the response. A server can answer
+// before reading the whole body, e.g. with a 413, and stop reading it, in
+// which case the upload is aborted and the response returned.
+func writeBodyAndReadResponse(sock deadlineConn, br *bufio.Reader, bw *bufio.Writer, req *parser.Request, chunked bool) (*parser.Response, error) {
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	if req.Body == parser.NoBody {
+		return readResponse(br, sock, req.Method)
+	}
+
+	u := &uploadConn{deadlineConn: sock, done: make(chan struct{})}
+	go func() {
+		defer close(u.done)
+		u.err = writeBody(bw, req, abortableReader{req.Body, &u.aborted}, chunked)
+		if u.err == nil {
+			u.err = bw.Flush()
+		}
+	}()
+
+	res, err := readResponse(br, u, req.Method)
+	if err != nil {
+		u.aborted.Store(true)
+		sock.Close()
+		// The write error tells more, e.g. when the server closed the
+		// connection without answering
+		select {
+		case <-u.done:
+			if u.err != nil && u.err != errUploadAborted {
+				return nil, u.err
+			}
+		default:
+		}
+		return nil, err
+	}
+
+	select {
+	case <-u.done:
+		if u.err != nil {
+			res.Close = true
+		}
+	default:
+		// The server answered before getting the whole body
+		u.aborted.Store(true)
+		res.Close = true
+	}
+
+	return res, nil
+}
+
+// Sends req on a connection from transport and reads the response. The
+// request is interrupted once its context is done or the deadline passes.
+func send(transport *transport.ConnectionManager, req *parser.Request, deadline time.Time, expectContinue time.Duration) (*parser.Response, error) {
+	ctx, stop := setRequestCancel(req, deadline)
+	getConnection := transport.GetConnectionContext
+	var res *parser.Response
+	for retried := false; ; retried = true {
+		sock, err := getConnection(ctx, canonicalAddr(req.URL))
+		if err != nil {
+			stop()
+			return nil, ctxErr(ctx, err)
+		}
+
+		conn := watchConn(ctx, sock)
+		res, err = roundTrip(conn, req, expectContinue)
+		if err == nil {
+			break
+		}
+
+		// The connection is left in an unknown state
+		conn.Close()
+
+		// The server may have closed a pooled connection as the request was
+		// sent. Nothing was answered, so it's safe to send once more.
+		if !retried && sock.Reused() && conn.nread == 0 && ctx.Err() == nil && canRetry(req) {
+			if req.ReadBody != nil {
+				if req.Body, err = req.ReadBody(); err != nil {
+					stop()
+					return nil, err
+				}
+			}
+			getConnection = transport.NewConnectionContext
+			continue
+		}
+
+		stop()
+		return nil, ctxErr(ctx, err)
+	}
+
+	if res.Body == nil {
+		res.Body = io.NopCloser(strings.NewReader(""))
+	}
+
+	res.Body = &cancelTimerBody{
+		stop: stop,
+		rc:   res.Body,
+		ctx:  ctx,
+	}
+
+	return res, nil
+}
+
+func roundTrip(sock *ctxConn, req *parser.Request, expectContinue time.Duration) (*parser.Response, error) {
 	bw := bufio.NewWriter(sock)
-	err = writeRequestLine(bw, req)
+	br := bufio.NewReader(sock)
+	err := writeRequestLine(bw, req)
 	if err != nil {
-		return nil, alwaysFalse, err
+		return nil, err
 	}
 	switch v := req.Body.(type) {
 	case *bytes.Buffer:
@@ -463,52 +654,144 @@ func send(transport *transport.ConnectionManager, req *parser.Request, deadline
 	case *strings.Reader:
 		req.ContentLength = int64(v.Len())
 	default:
-		if req.ContentLength == 0 {
+		if req.Body == nil || req.Body == parser.NoBody {
 			req.Body = parser.NoBody
+			req.ContentLength = 0
+		} else if req.ContentLength == 0 {
+			req.Body, req.ContentLength, err = probeBody(req.Body)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
+	// Bodies of unknown length are streamed in chunks, as are bodies
+	// followed by trailers
+	chunked := req.ContentLength < 0 || (req.Body != parser.NoBody && len(req.Trailer) > 0)
 
 	host := req.URL.Host
 	_, err = fmt.Fprintf(bw, "Host: %s\r\n", host)
 	if err != nil {
-		return nil, alwaysFalse, err
+		return nil, err
 	}
 
-	_, err = writeHeaders(req, bw, int(req.ContentLength), req.Headers)
-	if err != nil {
-		return nil, alwaysFalse, err
+	contentLen := int(req.ContentLength)
+	if chunked {
+		contentLen = -1
+		_, err = bw.WriteString("Transfer-Encoding: chunked\r\n")
+		if err != nil {
+			return nil, err
+		}
+
+		if err = writeTrailerHeader(bw, req.Trailer); err != nil {
+			return nil, err
+		}
+	}
+
+	if strings.EqualFold(req.Headers.Get("Expect"), "100-continue") {
+		expectContinue = cmp.Or(expectContinue, defaultExpectContinueTimeout)
+	} else if expectContinue > 0 && req.ContentLength != 0 {
+		_, err = bw.WriteString("Expect: 100-continue\r\n")
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	nr, err := io.Copy(bw, io.LimitReader(req.Body, req.ContentLength))
+	_, err = writeHeaders(req, bw, contentLen, req.Headers)
 	if err != nil {
-		return nil, alwaysFalse, err
+		return nil, err
 	}
-	if nr < req.ContentLength {
-		return nil, alwaysFalse, errors.New("http: Could not write whole body")
+
+	var res *parser.Response
+	if expectContinue > 0 && req.ContentLength != 0 {
+		res, err = awaitContinue(sock, br, bw, req.Method, expectContinue)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	err = bw.Flush()
+	// No final response yet, so the server wants the body
+	if res == nil {
+		res, err = writeBodyAndReadResponse(sock, br, bw, req, chunked)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	// TODO: Read response while writing request in case Server responds before we finish.
-	res, err := parser.ParseResponse(sock)
-	if err != nil {
-		stopTimer()
-		return nil, didTimeout, err
+	return res, nil
+}
+
+// Reads the final response to a request, skipping interim 1xx responses
+// other than 101 Switching Protocols.
+func readResponse(br *bufio.Reader, src transport.Reusable, method string) (*parser.Response, error) {
+	for {
+		res, err := parser.ParseResponseReader(br, src, method)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode/100 != 1 || res.StatusCode == status.SwitchingProtocols {
+			return res, nil
+		}
 	}
+}
 
-	if res.Body == nil {
-		res.Body = io.NopCloser(strings.NewReader(""))
+type deadlineConn interface {
+	transport.Reusable
+	transport.Drainer
+	transport.KeepAliver
+	io.Writer
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+}
+
+// Closes the connection instead of returning it to the pool, for exchanges
+// that leave it in an unknown state.
+type closeOnRelease struct {
+	transport.Reusable
+}
+
+func (c closeOnRelease) Release() {
+	c.Close()
+}
+
+// Sends the request headers and waits up to timeout for the server to
+// answer Expect: 100-continue, see RFC 9110, 10.1.1. Returns the final
+// response if the server answered without asking for the body, or nil if
+// the body should be sent.
+func awaitContinue(sock deadlineConn, br *bufio.Reader, bw *bufio.Writer, method string, timeout time.Duration) (*parser.Response, error) {
+	if err := bw.Flush(); err != nil {
+		return nil, err
 	}
 
-	if !deadline.IsZero() {
-		res.Body = &cancelTimerBody{
-			stop:          stopTimer,
-			rc:            io.NopCloser(res.Body),
-			reqDidTimeout: didTimeout,
+	sock.SetReadDeadline(time.Now().Add(timeout))
+	defer sock.SetReadDeadline(time.Time{})
+
+	// The server may still be expecting the body after a final response, so
+	// the connection can't be reused in that case.
+	var (
+		res *parser.Response
+		err error
+	)
+	for {
+		res, err = parser.ParseResponseReader(br, closeOnRelease{sock}, method)
+		if err != nil || res.StatusCode/100 != 1 || res.StatusCode == status.Continue {
+			break
 		}
 	}
 
-	return res, nil, nil
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		// The server didn't answer in time, send the body anyway
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case res.StatusCode == status.Continue:
+		return nil, nil
+	}
+
+	res.Close = true
+	return res, nil
 }
 
 func redirectBehavior(reqMethod string, res *parser.Response) (redirectMethod string, shouldRedirect bool, includeBody bool) {
@@ -534,9 +817,9 @@ func redirectBehavior(reqMethod string, res *parser.Response) (redirectMethod st
 }
 
 type cancelTimerBody struct {
-	stop          func()
-	rc            io.ReadCloser
-	reqDidTimeout func() bool
+	stop func()
+	rc   io.ReadCloser
+	ctx  context.Context
 }
 
 func (b *cancelTimerBody) Read(p []byte) (n int, err error) {
@@ -549,8 +832,8 @@ func (b *cancelTimerBody) Read(p []byte) (n int, err error) {
 		return n, err
 	}
 
-	if b.reqDidTimeout() {
-		err = fmt.Errorf("%w (Request timeout or cancellation while reading body)", err)
+	if b.ctx.Err() != nil {
+		err = fmt.Errorf("%w (Request timeout or cancellation while reading body)", ctxErr(b.ctx, err))
 	}
 
 	return n, err
@@ -0,0 +1,89 @@
+package context
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/arthur-teixeira/go-http/status"
+)
+
+// A Middleware runs as part of a chain in front of a Handler. It can run the
+// rest of the chain by calling Context.Next and act after it returns, or stop
+// the chain with Context.Abort. Middlewares that call neither let the chain
+// continue once they return.
+type Middleware func(c *Context)
+
+type chain []Middleware
+
+// Returns a Handler that runs mws in order before h.
+func Chain(h Handler, mws ...Middleware) Handler {
+	if len(mws) == 0 {
+		return h
+	}
+
+	handlers := make(chain, 0, len(mws)+1)
+	handlers = append(handlers, mws...)
+	return append(handlers, h.ServeHTTP)
+}
+
+func (ch chain) ServeHTTP(c *Context) {
+	// Chains can be nested, e.g. a route's middlewares inside the ones set
+	// on the server Handler, so the outer chain is resumed afterwards.
+	handlers, index := c.handlers, c.index
+	c.handlers, c.index = ch, -1
+	c.Next()
+	c.handlers, c.index = handlers, index
+}
+
+// Runs the remaining handlers of the chain. Meant to be called from inside
+// a Middleware.
+func (c *Context) Next() {
+	c.index++
+	for c.index < len(c.handlers) && !c.aborted {
+		c.handlers[c.index](c)
+		c.index++
+	}
+}
+
+// Prevents the handlers after the current one from running. Handlers that
+// already called Next still run their remaining code.
+func (c *Context) Abort() {
+	c.aborted = true
+}
+
+func (c *Context) IsAborted() bool {
+	return c.aborted
+}
+
+func (c *Context) AbortWithStatus(code int) {
+	c.WriteHeader(code)
+	c.Abort()
+}
+
+// Logs the method, path, status and duration of every request
+func Logger() Middleware {
+	return func(c *Context) {
+		start := time.Now()
+		c.Next()
+		log.Printf("%s %s %d %s", c.Request.Method, c.Request.URL.Path, c.Response.status, time.Since(start))
+	}
+}
+
+// Recovers from panics in the rest of the chain, answering with a 500 if no
+// response was written yet. Should be the first middleware of the chain.
+func Recovery() Middleware {
+	return func(c *Context) {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("Recovered from panic: %v\n%s", err, debug.Stack())
+				if !c.Response.wroteHeader {
+					c.WriteHeader(status.InternalServerError)
+				}
+				c.Abort()
+			}
+		}()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,301 @@
+package context
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arthur-teixeira/go-http/chunkedreader"
+	"github.com/arthur-teixeira/go-http/parser"
+	"github.com/arthur-teixeira/go-http/status"
+)
+
+// Body bytes held back before deciding on the framing of a response.
+// Responses that fit entirely are sent with a Content-Length, larger ones
+// are streamed.
+const bufferBeforeChunking = 2048
+
+var (
+	ErrBodyNotAllowed = errors.New("http: request method or response status code does not allow body")
+	ErrContentLength  = errors.New("http: wrote more than the declared Content-Length")
+)
+
+// Writes a response in a streaming fashion. The status and headers are
+// committed by the first call to WriteHeader or Write, but only sent once
+// the body outgrows an internal buffer, Flush is called or the handler
+// returns. When the length of the body isn't known by then, it is sent with
+// the chunked transfer coding to HTTP/1.1 clients, and delimited by closing
+// the connection for HTTP/1.0 ones.
+//
+// Changes to Headers after the headers are committed have no effect.
+type ResponseWriter struct {
+	bw             *bufio.Writer
+	req            *parser.Request
+	conn           *serverConn           // nil for writers not owned by a Server
+	continueReader *expectContinueReader // Set when the client waits for 100 Continue to send the body
+	status         int
+	Headers        parser.Headers
+	snapshot       parser.Headers               // Copy of Headers taken on commit, which is what gets sent
+	wroteHeader    bool                         // Status and headers are committed
+	sentHeader     bool                         // Status line and headers were written to bw
+	buf            []byte                       // Body held back until the headers are sent
+	contentLen     int64                        // Declared length of the body, -1 if unknown
+	written        int64                        // Body bytes written by the handler
+	cw             *chunkedreader.ChunkedWriter // Set when the body is sent chunked
+}
+
+func NewWriter(bw *bufio.Writer, req *parser.Request) ResponseWriter {
+	return ResponseWriter{
+		bw:         bw,
+		req:        req,
+		Headers:    make(parser.Headers),
+		contentLen: -1,
+	}
+}
+
+// Commits the status code of the response. A Content-Length set in the
+// headers at this point is enforced on the body.
+func (w *ResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		log.Printf("[WARNING]: Header was already written. Tried to overwrite %d with %d", w.status, code)
+		return
+	}
+
+	w.status = code
+	w.wroteHeader = true
+	w.snapshot = w.Headers.Clone()
+	if w.snapshot == nil {
+		w.snapshot = make(parser.Headers)
+	}
+
+	if cl := w.snapshot.Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			log.Printf("[WARNING]: Ignoring invalid Content-Length %q", cl)
+			w.snapshot.Del("Content-Length")
+		} else {
+			w.contentLen = n
+		}
+	}
+}
+
+func (w *ResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(status.OK) // Following Go default behavior
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if !parser.BodyAllowedForStatus(w.status) {
+		return 0, ErrBodyNotAllowed
+	}
+
+	if w.contentLen >= 0 && w.written+int64(len(p)) > w.contentLen {
+		return 0, ErrContentLength
+	}
+	w.written += int64(len(p))
+
+	if !w.sentHeader {
+		if len(w.buf)+len(p) <= bufferBeforeChunking {
+			w.buf = append(w.buf, p...)
+			return len(p), nil
+		}
+
+		if err := w.sendHeader(false, p); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := w.writeBody(p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Sends the headers and any buffered body to the client. Afterwards, the
+// rest of the body is streamed.
+func (w *ResponseWriter) Flush() error {
+	if !w.wroteHeader {
+		w.WriteHeader(status.OK)
+	}
+
+	if !w.sentHeader {
+		if err := w.sendHeader(false, nil); err != nil {
+			return err
+		}
+	}
+
+	return w.bw.Flush()
+}
+
+// Completes the response once the handler returns
+func (w *ResponseWriter) finish() error {
+	if !w.wroteHeader {
+		w.WriteHeader(status.OK)
+	}
+
+	if !w.sentHeader {
+		if err := w.sendHeader(true, nil); err != nil {
+			return err
+		}
+	}
+
+	if w.cw != nil {
+		if err := w.cw.Close(); err != nil {
+			return err
+		}
+	}
+
+	if w.contentLen >= 0 && w.written < w.contentLen && w.sendsBody() {
+		// The client is still waiting for the rest of the declared body
+		w.req.Close = true
+	}
+
+	return w.bw.Flush()
+}
+
+// Picks the framing of the body and writes the status line, the headers and
+// whatever was buffered so far. final is set when the handler has returned,
+// so the buffer holds the whole body. next is the body written right after,
+// which the Content-Type is also sniffed from.
+func (w *ResponseWriter) sendHeader(final bool, next []byte) error {
+	hdrs := w.snapshot
+	switch {
+	case !parser.BodyAllowedForStatus(w.status):
+	case w.contentLen >= 0:
+	case final:
+		w.contentLen = int64(len(w.buf))
+		hdrs.Set("Content-Length", strconv.Itoa(len(w.buf)))
+	case w.req.Method == "HEAD":
+		// The length is unknown, and there's no body to frame anyway
+	case w.req.ProtoAtLeast(1, 1):
+		w.cw = chunkedreader.NewChunkedWriter(w.bw)
+		hdrs.Set("Transfer-Encoding", "chunked")
+	default:
+		// HTTP/1.0 clients read the body until the connection is closed
+		w.req.Close = true
+	}
+
+	if _, ok := hdrs["Date"]; !ok {
+		hdrs.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	if _, ok := hdrs["Content-Type"]; !ok {
+		if sniff := w.sniffData(next); len(sniff) > 0 {
+			hdrs.Set("Content-Type", http.DetectContentType(sniff))
+		}
+	}
+
+	if w.conn != nil {
+		if name := w.conn.server.Name; name != "" {
+			if _, ok := hdrs["Server"]; !ok {
+				hdrs.Set("Server", name)
+			}
+		}
+
+		if w.conn.server.shuttingDown() {
+			w.req.Close = true
+		}
+	}
+
+	// The handler rejected the body by not reading it. The client may send
+	// it anyway after waiting, so we can't tell where the next request starts.
+	if w.continueReader != nil && !w.continueReader.sent {
+		w.req.Close = true
+	}
+
+	if strings.EqualFold(hdrs.Get("Connection"), "close") {
+		// Sent by writeHeaders
+		hdrs.Del("Connection")
+		w.req.Close = true
+	}
+
+	if w.conn != nil && !w.req.Close {
+		// HTTP/1.0 clients assume the connection closes unless told
+		// otherwise, see RFC 9112, 9.3
+		if !w.req.ProtoAtLeast(1, 1) {
+			hdrs.Set("Connection", "keep-alive")
+		}
+		if secs := int(w.conn.server.idleTimeout() / time.Second); secs > 0 {
+			hdrs.Set("Keep-Alive", "timeout="+strconv.Itoa(secs))
+		}
+	}
+
+	if err := w.writeStatusLine(); err != nil {
+		return err
+	}
+
+	if _, err := writeHeaders(w.req, w.bw, 0, hdrs); err != nil {
+		return err
+	}
+	w.sentHeader = true
+
+	buf := w.buf
+	w.buf = nil
+	return w.writeBody(buf)
+}
+
+// Bytes DetectContentType considers at most
+const sniffLen = 512
+
+// Returns the start of the body, made of the buffer followed by next
+func (w *ResponseWriter) sniffData(next []byte) []byte {
+	if len(w.buf) >= sniffLen || len(next) == 0 {
+		return w.buf
+	}
+
+	data := make([]byte, 0, sniffLen)
+	data = append(data, w.buf...)
+	return append(data, next[:min(len(next), sniffLen-len(data))]...)
+}
+
+// Whether the body is sent to the client. Responses to HEAD requests are
+// written by the handler as for GET, to get the same headers, but the body
+// is discarded.
+func (w *ResponseWriter) sendsBody() bool {
+	return w.req.Method != "HEAD" && parser.BodyAllowedForStatus(w.status)
+}
+
+func (w *ResponseWriter) writeBody(p []byte) error {
+	if len(p) == 0 || !w.sendsBody() {
+		return nil
+	}
+
+	if w.cw != nil {
+		_, err := w.cw.Write(p)
+		return err
+	}
+
+	_, err := w.bw.Write(p)
+	return err
+}
+
+// Writes the response Status Line e.g: HTTP/1.1 200 OK
+func (w *ResponseWriter) writeStatusLine() error {
+	code := w.status
+
+	if w.req.ProtoAtLeast(1, 1) {
+		w.bw.WriteString("HTTP/1.1 ")
+	} else {
+		w.bw.WriteString("HTTP/1.0 ")
+	}
+
+	if text := status.Text(code); text != "" {
+		w.bw.WriteString(strconv.Itoa(code))
+		w.bw.WriteByte(' ')
+		w.bw.WriteString(text)
+		_, err := w.bw.WriteString("\r\n")
+		return err
+	}
+
+	_, err := fmt.Fprintf(w.bw, "%03d status code %d\r\n", code, code)
+	return err
+}
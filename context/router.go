@@ -0,0 +1,291 @@
+package context
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/arthur-teixeira/go-http/status"
+)
+
+type Param struct {
+	Key   string
+	Value string
+}
+
+// Values captured from :param and *wildcard segments, in the order they
+// appear in the route.
+type Params []Param
+
+func (ps Params) ByName(name string) string {
+	for _, p := range ps {
+		if p.Key == name {
+			return p.Value
+		}
+	}
+
+	return ""
+}
+
+// One segment of a registered route. Static children are matched first, then
+// the :param child and finally the *wildcard child, which consumes the rest
+// of the path.
+type node struct {
+	static   map[string]*node
+	param    *node
+	wildcard *node
+	name     string             // Parameter name, for param and wildcard nodes
+	handlers map[string]Handler // Keyed by request method
+}
+
+func splitPath(path string) []string {
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return nil
+	}
+
+	return strings.Split(path, "/")
+}
+
+func (n *node) insert(pattern string) *node {
+	segs := splitPath(pattern)
+	for i, seg := range segs {
+		switch {
+		case strings.HasPrefix(seg, ":"):
+			n.param = child(n.param, seg[1:], pattern)
+			n = n.param
+		case strings.HasPrefix(seg, "*"):
+			if i != len(segs)-1 {
+				panic(fmt.Sprintf("router: wildcard must be the last segment in %q", pattern))
+			}
+			n.wildcard = child(n.wildcard, seg[1:], pattern)
+			n = n.wildcard
+		default:
+			if n.static == nil {
+				n.static = make(map[string]*node)
+			}
+			next := n.static[seg]
+			if next == nil {
+				next = &node{}
+				n.static[seg] = next
+			}
+			n = next
+		}
+	}
+
+	return n
+}
+
+// Returns the param or wildcard node named name, creating it if needed.
+// Two routes can't use different names for the same position.
+func child(n *node, name string, pattern string) *node {
+	if name == "" {
+		panic(fmt.Sprintf("router: unnamed parameter in %q", pattern))
+	}
+
+	if n == nil {
+		return &node{name: name}
+	}
+
+	if n.name != name {
+		panic(fmt.Sprintf("router: %q conflicts with existing parameter %q", pattern, n.name))
+	}
+
+	return n
+}
+
+func (n *node) match(segs []string, params Params) (*node, Params) {
+	if len(segs) == 0 {
+		if len(n.handlers) > 0 {
+			return n, params
+		}
+		if n.wildcard != nil {
+			return n.wildcard, append(params, Param{Key: n.wildcard.name})
+		}
+
+		return nil, params
+	}
+
+	if next := n.static[segs[0]]; next != nil {
+		if found, ps := next.match(segs[1:], params); found != nil {
+			return found, ps
+		}
+	}
+
+	if n.param != nil && segs[0] != "" {
+		ps := append(params, Param{Key: n.param.name, Value: segs[0]})
+		if found, ps := n.param.match(segs[1:], ps); found != nil {
+			return found, ps
+		}
+	}
+
+	if n.wildcard != nil {
+		return n.wildcard, append(params, Param{Key: n.wildcard.name, Value: strings.Join(segs, "/")})
+	}
+
+	return nil, params
+}
+
+// Returns the handler for method. HEAD requests fall back to the GET
+// handler, with the body discarded by the ResponseWriter.
+func (n *node) handler(method string) (Handler, bool) {
+	h, ok := n.handlers[method]
+	if !ok && method == "HEAD" {
+		h, ok = n.handlers["GET"]
+	}
+
+	return h, ok
+}
+
+// Value for the Allow header of a 405 response
+func (n *node) allow() string {
+	methods := make([]string, 0, len(n.handlers)+1)
+	for m := range n.handlers {
+		methods = append(methods, m)
+	}
+	if _, ok := n.handler("HEAD"); ok && !slices.Contains(methods, "HEAD") {
+		methods = append(methods, "HEAD")
+	}
+	slices.Sort(methods)
+
+	return strings.Join(methods, ", ")
+}
+
+// A set of routes sharing a path prefix and middlewares
+type RouteGroup struct {
+	router      *Router
+	prefix      string
+	middlewares []Middleware
+}
+
+func joinPaths(prefix, path string) string {
+	if path == "" {
+		return prefix
+	}
+
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// Creates a sub-group under prefix. It inherits the middlewares registered
+// on g so far.
+func (g *RouteGroup) Group(prefix string, mws ...Middleware) *RouteGroup {
+	return &RouteGroup{
+		router:      g.router,
+		prefix:      joinPaths(g.prefix, prefix),
+		middlewares: append(slices.Clip(g.middlewares), mws...),
+	}
+}
+
+// Adds middlewares to the group. They only apply to routes registered
+// afterwards.
+func (g *RouteGroup) Use(mws ...Middleware) {
+	g.middlewares = append(g.middlewares, mws...)
+}
+
+// Registers h for method and path. The group middlewares run first,
+// followed by mws.
+func (g *RouteGroup) Handle(method, path string, h Handler, mws ...Middleware) {
+	pattern := joinPaths(g.prefix, path)
+	if !strings.HasPrefix(pattern, "/") {
+		panic(fmt.Sprintf("router: path %q must begin with '/'", pattern))
+	}
+
+	n := g.router.root.insert(pattern)
+	if n.handlers == nil {
+		n.handlers = make(map[string]Handler)
+	}
+	if _, ok := n.handlers[method]; ok {
+		panic(fmt.Sprintf("router: %s %q is already registered", method, pattern))
+	}
+	n.handlers[method] = Chain(h, append(slices.Clip(g.middlewares), mws...)...)
+}
+
+func (g *RouteGroup) HandleFunc(method, path string, h HandlerFunc, mws ...Middleware) {
+	g.Handle(method, path, h, mws...)
+}
+
+func (g *RouteGroup) GET(path string, h HandlerFunc, mws ...Middleware) {
+	g.Handle("GET", path, h, mws...)
+}
+
+func (g *RouteGroup) HEAD(path string, h HandlerFunc, mws ...Middleware) {
+	g.Handle("HEAD", path, h, mws...)
+}
+
+func (g *RouteGroup) POST(path string, h HandlerFunc, mws ...Middleware) {
+	g.Handle("POST", path, h, mws...)
+}
+
+func (g *RouteGroup) PUT(path string, h HandlerFunc, mws ...Middleware) {
+	g.Handle("PUT", path, h, mws...)
+}
+
+func (g *RouteGroup) PATCH(path string, h HandlerFunc, mws ...Middleware) {
+	g.Handle("PATCH", path, h, mws...)
+}
+
+func (g *RouteGroup) DELETE(path string, h HandlerFunc, mws ...Middleware) {
+	g.Handle("DELETE", path, h, mws...)
+}
+
+func (g *RouteGroup) OPTIONS(path string, h HandlerFunc, mws ...Middleware) {
+	g.Handle("OPTIONS", path, h, mws...)
+}
+
+// Dispatches requests on their method and path. Routes are registered
+// through the embedded root RouteGroup and may contain :param segments,
+// matching a single path segment, and a trailing *wildcard segment matching
+// the rest of the path. Captured values are available through Context.Param.
+// Middlewares added with Use on the Router also run for 404 and 405
+// responses.
+type Router struct {
+	RouteGroup
+	root             node
+	NotFound         Handler // Defaults to a plain 404 response
+	MethodNotAllowed Handler // Defaults to a plain 405 response. Allow is set before it runs
+}
+
+func NewRouter() *Router {
+	r := &Router{}
+	r.RouteGroup.router = r
+	return r
+}
+
+func (r *Router) ServeHTTP(c *Context) {
+	n, params := r.root.match(splitPath(c.Request.URL.Path), nil)
+	if n == nil {
+		r.notFound().ServeHTTP(c)
+		return
+	}
+
+	h, ok := n.handler(c.Request.Method)
+	if !ok {
+		c.Header("Allow", n.allow())
+		r.methodNotAllowed().ServeHTTP(c)
+		return
+	}
+
+	c.Params = params
+	h.ServeHTTP(c)
+}
+
+func (r *Router) notFound() Handler {
+	if r.NotFound != nil {
+		return Chain(r.NotFound, r.middlewares...)
+	}
+
+	return Chain(HandlerFunc(notFound), r.middlewares...)
+}
+
+func (r *Router) methodNotAllowed() Handler {
+	if r.MethodNotAllowed != nil {
+		return Chain(r.MethodNotAllowed, r.middlewares...)
+	}
+
+	return Chain(HandlerFunc(methodNotAllowed), r.middlewares...)
+}
+
+func methodNotAllowed(c *Context) {
+	c.WriteHeader(status.MethodNotAllowed)
+	c.WriteString(status.Text(status.MethodNotAllowed))
+}
@@ -0,0 +1,111 @@
+package context_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/arthur-teixeira/go-http/context"
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, addr, method, path string) string {
+	return roundTrip(t, addr, method+" "+path+" HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+}
+
+func TestRouter(t *testing.T) {
+	r := context.NewRouter()
+	r.GET("/users/:id", func(c *context.Context) {
+		c.WriteString("user " + c.Param("id"))
+	})
+	r.GET("/users/me", func(c *context.Context) {
+		c.WriteString("me")
+	})
+	r.POST("/users/:id", func(c *context.Context) {
+		c.WriteString("updated " + c.Param("id"))
+	})
+	api := r.Group("/api/v1")
+	api.GET("/files/*path", func(c *context.Context) {
+		c.WriteString("file " + c.Param("path"))
+	})
+	addr := startServer(t, &context.Server{Handler: r})
+
+	assert.True(t, strings.HasSuffix(get(t, addr, "GET", "/users/42"), "user 42"))
+	assert.True(t, strings.HasSuffix(get(t, addr, "GET", "/users/me"), "\r\n\r\nme"))
+	assert.True(t, strings.HasSuffix(get(t, addr, "POST", "/users/7"), "updated 7"))
+	assert.True(t, strings.HasSuffix(get(t, addr, "GET", "/api/v1/files/css/site.css"), "file css/site.css"))
+
+	res := get(t, addr, "GET", "/nothing")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), res)
+
+	res = get(t, addr, "DELETE", "/users/42")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 405 Method Not Allowed\r\n"), res)
+	assert.Contains(t, res, "Allow: GET, HEAD, POST\r\n")
+}
+
+func TestRouterConflictingParams(t *testing.T) {
+	r := context.NewRouter()
+	r.GET("/users/:id", func(c *context.Context) {})
+	assert.Panics(t, func() {
+		r.GET("/users/:name/posts", func(c *context.Context) {})
+	})
+	assert.Panics(t, func() {
+		r.GET("/users/:id", func(c *context.Context) {})
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	trace := func(name string) context.Middleware {
+		return func(c *context.Context) {
+			c.Header("X-Trace", c.Response.Headers.Get("X-Trace")+name+">")
+			c.Next()
+		}
+	}
+	auth := func(c *context.Context) {
+		if c.Request.Headers.Get("Authorization") == "" {
+			c.AbortWithStatus(401)
+		}
+	}
+
+	r := context.NewRouter()
+	r.Use(trace("router"))
+	admin := r.Group("/admin", trace("group"))
+	admin.GET("/stats", func(c *context.Context) {
+		c.WriteString("stats")
+	}, auth)
+	addr := startServer(t, &context.Server{Handler: context.Chain(r, trace("server"))})
+
+	res := get(t, addr, "GET", "/admin/stats")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 401 Unauthorized\r\n"), res)
+	assert.Contains(t, res, "X-Trace: server>router>group>\r\n")
+	assert.NotContains(t, res, "stats")
+
+	res = roundTrip(t, addr, "GET /admin/stats HTTP/1.1\r\nAuthorization: x\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nstats"), res)
+
+	res = get(t, addr, "GET", "/missing")
+	assert.Contains(t, res, "X-Trace: server>router>\r\n")
+}
+
+func TestRecovery(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		Handler: context.Chain(context.HandlerFunc(func(c *context.Context) {
+			panic("boom")
+		}), context.Recovery()),
+	})
+
+	res := get(t, addr, "GET", "/")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 500 Internal Server Error\r\n"), res)
+}
+
+func TestRouterHead(t *testing.T) {
+	r := context.NewRouter()
+	r.GET("/page", func(c *context.Context) {
+		c.WriteString("some page")
+	})
+	addr := startServer(t, &context.Server{Handler: r})
+
+	res := get(t, addr, "HEAD", "/page")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"), res)
+	assert.Contains(t, res, "Content-Length: 9\r\n")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\n"), res)
+}
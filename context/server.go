@@ -0,0 +1,707 @@
+package context
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arthur-teixeira/go-http/parser"
+	"github.com/arthur-teixeira/go-http/status"
+	"github.com/arthur-teixeira/go-http/transport"
+)
+
+// A Handler responds to a single request, writing the response through the
+// Context it receives.
+type Handler interface {
+	ServeHTTP(c *Context)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface.
+type HandlerFunc func(c *Context)
+
+func (f HandlerFunc) ServeHTTP(c *Context) {
+	f(c)
+}
+
+// Returned by Serve and ListenAndServe after Shutdown or Close
+var ErrServerClosed = errors.New("http: Server closed")
+
+type Server struct {
+	Addr           string // TCP address to listen on, ":http" if empty
+	Handler        Handler
+	MaxConnections int    // Max simultaneous connections, 0 means no limit
+	Name           string // Sent as the Server header of responses, unless empty
+
+	// Timeouts are disabled when zero or negative.
+	ReadHeaderTimeout time.Duration // Time to read the request line and headers. Defaults to ReadTimeout
+	ReadTimeout       time.Duration // Time to read the whole request, body included
+	WriteTimeout      time.Duration // Time to write the response, counting from the end of the request headers
+	IdleTimeout       time.Duration // Time to wait for the next request on a persistent connection. Defaults to ReadTimeout
+
+	// Request body left unread by a handler that is discarded to keep the
+	// connection alive. Larger leftovers close the connection. Defaults to
+	// 256KB, negative values always close.
+	MaxDrainBytes int64
+
+	// Handle pipelined requests without a body concurrently, instead of one
+	// after the other. Responses are always written in the order of the
+	// requests.
+	ConcurrentPipelining bool
+	// Max pipelined requests handled concurrently on a connection. Reading
+	// further requests waits for one of them to finish. Defaults to 16.
+	MaxPipelineDepth int
+
+	// Limits on the size of requests, answered with 414, 431 and 413
+	// respectively. The header limits default to 8KB for the request line,
+	// 1MB for all header lines and 100 header fields, negative values mean no
+	// limit. A MaxBodyBytes of zero means no limit.
+	MaxRequestLineLength int
+	MaxHeaderBytes       int
+	MaxHeaderCount       int
+	MaxBodyBytes         int64
+
+	// Reject malformed or ambiguous requests with 400 instead of parsing them
+	// leniently, see parser.RequestOptions.
+	StrictParsing bool
+
+	inShutdown atomic.Bool
+	mu         sync.Mutex // Protects the fields below
+	listeners  map[*net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+	onShutdown []func()
+}
+
+func (s *Server) ListenAndServe() error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+
+	addr := s.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+
+	sock, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(sock)
+}
+
+// Accepts incoming connections on l, serving each one on its own goroutine.
+// Serve always returns a non-nil error and closes l. After Shutdown or Close
+// the error is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(&l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(&l, false)
+	defer l.Close()
+
+	var slots chan struct{}
+	if s.MaxConnections > 0 {
+		slots = make(chan struct{}, s.MaxConnections)
+	}
+
+	var backoff time.Duration
+	for {
+		if slots != nil {
+			slots <- struct{}{}
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			if slots != nil {
+				<-slots
+			}
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			log.Println("Error accepting connection: ", err)
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		c := s.newConn(conn)
+		go func() {
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			c.serve()
+		}()
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+// Registers a function to call when Shutdown is called. Each function runs
+// on its own goroutine, and Shutdown doesn't wait for them.
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.mu.Lock()
+	s.onShutdown = append(s.onShutdown, f)
+	s.mu.Unlock()
+}
+
+// Gracefully stops the server. It closes all listeners, then closes
+// connections as soon as they are idle, waiting for in-flight requests to
+// finish. New connections get a few seconds to send their first request.
+// If ctx expires first, the context's error is returned and the
+// remaining connections are left open; call Close to terminate them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	err := s.closeListeners()
+	for _, f := range s.onShutdown {
+		go f()
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Immediately closes all listeners and connections, including the ones with
+// requests in flight.
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.closeListeners()
+	for c := range s.conns {
+		c.rwc.Close()
+		delete(s.conns, c)
+	}
+
+	return err
+}
+
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Must be called with s.mu held
+func (s *Server) closeListeners() error {
+	var err error
+	for l := range s.listeners {
+		if cerr := (*l).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// Time a new connection gets to send its first request once Shutdown is
+// called, since the client may be sending it already
+const newConnGracePeriod = 5 * time.Second
+
+// Closes every connection that isn't serving a request, reporting whether
+// no connections are left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		st := c.state.Load()
+		if st == stateActive || (st == stateNew && time.Since(c.createdAt) < newConnGracePeriod) {
+			continue
+		}
+		// Fails if a request started to arrive in the meantime
+		if !c.state.CompareAndSwap(st, stateClosed) {
+			continue
+		}
+		c.rwc.Close()
+		delete(s.conns, c)
+	}
+
+	return len(s.conns) == 0
+}
+
+// Adds or removes l from the listeners closed on shutdown. Returns false if
+// the server is already shutting down.
+func (s *Server) trackListener(l *net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+
+	if s.shuttingDown() {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[*net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) trackConn(c *serverConn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, c)
+		return
+	}
+
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]struct{})
+	}
+	s.conns[c] = struct{}{}
+}
+
+func (s *Server) maxDrainBytes() int64 {
+	if s.MaxDrainBytes == 0 {
+		return transport.DefaultMaxDrainBytes
+	}
+
+	return max(s.MaxDrainBytes, 0)
+}
+
+const (
+	defaultMaxRequestLineLength = 8 << 10
+	defaultMaxHeaderBytes       = 1 << 20
+	defaultMaxHeaderCount       = 100
+)
+
+func (s *Server) requestOptions() parser.RequestOptions {
+	limit := func(v, def int) int {
+		if v == 0 {
+			return def
+		}
+		return max(v, 0)
+	}
+
+	return parser.RequestOptions{
+		MaxRequestLineLength: limit(s.MaxRequestLineLength, defaultMaxRequestLineLength),
+		MaxHeaderBytes:       limit(s.MaxHeaderBytes, defaultMaxHeaderBytes),
+		MaxHeaderCount:       limit(s.MaxHeaderCount, defaultMaxHeaderCount),
+		Strict:               s.StrictParsing,
+	}
+}
+
+const defaultMaxPipelineDepth = 16
+
+func (s *Server) maxPipelineDepth() int {
+	if s.MaxPipelineDepth > 0 {
+		return s.MaxPipelineDepth
+	}
+
+	return defaultMaxPipelineDepth
+}
+
+func (s *Server) readHeaderTimeout() time.Duration {
+	if s.ReadHeaderTimeout > 0 {
+		return s.ReadHeaderTimeout
+	}
+
+	return s.ReadTimeout
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+
+	return s.ReadTimeout
+}
+
+// Returns the deadline d from now, or the zero time, meaning no deadline,
+// for a disabled timeout.
+func deadlineAfter(d time.Duration) time.Time {
+	if d > 0 {
+		return time.Now().Add(d)
+	}
+
+	return time.Time{}
+}
+
+func (s *Server) handler() Handler {
+	if s.Handler == nil {
+		return HandlerFunc(notFound)
+	}
+
+	return s.Handler
+}
+
+const (
+	stateNew    int32 = iota // Accepted, waiting for the first request
+	stateActive              // Reading a request or running its handler
+	stateIdle                // Waiting for the next request on a persistent connection
+	stateClosed              // Closed by Shutdown while not serving a request
+)
+
+// Server side of a single connection. The buffered reader and writer live as
+// long as the connection, across all of its requests.
+type serverConn struct {
+	server    *Server
+	rwc       net.Conn
+	br        *bufio.Reader
+	bw        *bufio.Writer
+	state     atomic.Int32
+	createdAt time.Time
+	pipeline  chan struct{} // Slots for pipelined requests processed concurrently
+	closing   atomic.Bool   // Set when a pipelined response ends the connection
+}
+
+func (s *Server) newConn(rwc net.Conn) *serverConn {
+	c := &serverConn{
+		server:    s,
+		rwc:       rwc,
+		br:        bufio.NewReader(rwc),
+		bw:        bufio.NewWriter(rwc),
+		createdAt: time.Now(),
+	}
+	if s.ConcurrentPipelining {
+		c.pipeline = make(chan struct{}, s.maxPipelineDepth())
+	}
+	s.trackConn(c, true)
+	return c
+}
+
+func (c *serverConn) close() {
+	c.server.trackConn(c, false)
+	c.rwc.Close()
+}
+
+func (c *serverConn) serve() {
+	defer c.close()
+
+	s := c.server
+	// Closed once the responses to all previous requests are written. Only
+	// pipelined requests processed concurrently leave it open.
+	prev := closedChan
+	defer func() { <-prev }()
+
+	for {
+		// The first request has to arrive within the header timeout, later
+		// ones within the idle timeout.
+		st := c.state.Load()
+		if st == stateNew {
+			c.rwc.SetReadDeadline(deadlineAfter(s.readHeaderTimeout()))
+		} else {
+			c.rwc.SetReadDeadline(deadlineAfter(s.idleTimeout()))
+		}
+
+		// Only become active once the client starts sending the request, so
+		// that Shutdown can close connections that are just waiting.
+		if _, err := c.br.Peek(1); err != nil {
+			return
+		}
+		if !c.state.CompareAndSwap(st, stateActive) {
+			// Shutdown closed the connection first
+			return
+		}
+
+		// Replaces the idle deadline, or clears it when headers have no
+		// timeout
+		start := time.Now()
+		c.rwc.SetReadDeadline(deadlineAfter(s.readHeaderTimeout()))
+
+		ctx, err := newContext(c.br, c.bw, s.requestOptions())
+		if err != nil {
+			<-prev
+			c.rwc.SetWriteDeadline(deadlineAfter(s.WriteTimeout))
+			var netErr net.Error
+			switch {
+			case errors.As(err, &netErr) && netErr.Timeout():
+				writeError(c.rwc, status.RequestTimeout, "")
+			case errors.Is(err, parser.ErrRequestLineTooLong):
+				writeError(c.rwc, status.RequestURITooLong, "")
+			case errors.Is(err, parser.ErrHeadersTooLarge):
+				writeError(c.rwc, status.RequestHeaderFieldsTooLarge, "")
+			case !isConnError(err):
+				writeError(c.rwc, status.BadRequest, err.Error())
+			}
+			return
+		}
+		ctx.Response.conn = c
+
+		if s.ReadTimeout > 0 {
+			c.rwc.SetReadDeadline(start.Add(s.ReadTimeout))
+		} else {
+			c.rwc.SetReadDeadline(time.Time{})
+		}
+
+		if c.canPipeline(ctx) {
+			done := make(chan struct{})
+			c.pipeline <- struct{}{}
+			go c.serveAsync(ctx, prev, done)
+			prev = done
+			continue
+		}
+
+		<-prev
+		if c.closing.Load() {
+			return
+		}
+		c.rwc.SetWriteDeadline(deadlineAfter(s.WriteTimeout))
+
+		// Checked before answering 100 Continue, so that the client doesn't
+		// send a body that is too large
+		var mbr *maxBytesReader
+		if n := s.MaxBodyBytes; n > 0 && ctx.Request.Body != parser.NoBody {
+			if ctx.Request.ContentLength > n {
+				writeError(c.rwc, status.RequestEntityTooLarge, "")
+				return
+			}
+			mbr = newMaxBytesReader(ctx, ctx.Request.Body, n)
+			ctx.Request.Body = mbr
+		}
+
+		if !ctx.handleExpect() {
+			writeError(c.rwc, status.ExpectationFailed, "")
+			return
+		}
+
+		s.handler().ServeHTTP(ctx)
+		var mbe *MaxBytesError
+		if mbr != nil && errors.As(mbr.err, &mbe) && !ctx.Response.wroteHeader {
+			ctx.WriteHeader(status.RequestEntityTooLarge)
+			ctx.WriteString(status.Text(status.RequestEntityTooLarge))
+		}
+		ctx.discardBody(s.maxDrainBytes())
+		if err := ctx.finish(); err != nil {
+			return
+		}
+
+		if ctx.Request.Close || s.shuttingDown() {
+			return
+		}
+		c.state.Store(stateIdle)
+	}
+}
+
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// Whether the request can be handled while the next ones are read. Only
+// requests without a body qualify, since the next request starts where the
+// body ends, and only if the client already sent more requests.
+func (c *serverConn) canPipeline(ctx *Context) bool {
+	return c.server.ConcurrentPipelining &&
+		ctx.Request.Body == parser.NoBody &&
+		ctx.Request.Headers.Get("Expect") == "" &&
+		!ctx.Request.Close &&
+		!c.closing.Load() &&
+		c.br.Buffered() > 0
+}
+
+// Runs the handler of a pipelined request with the response held in memory,
+// then writes it to the connection once the responses to all previous
+// requests, which prev waits for, are written.
+func (c *serverConn) serveAsync(ctx *Context, prev chan struct{}, done chan struct{}) {
+	defer close(done)
+	defer func() { <-c.pipeline }()
+
+	var buf bytes.Buffer
+	ctx.Response.bw = bufio.NewWriter(&buf)
+	c.server.handler().ServeHTTP(ctx)
+	err := ctx.finish()
+
+	<-prev
+	if err != nil || c.closing.Load() {
+		c.closing.Store(true)
+		return
+	}
+
+	c.rwc.SetWriteDeadline(deadlineAfter(c.server.WriteTimeout))
+	if _, err := c.bw.Write(buf.Bytes()); err != nil {
+		c.closing.Store(true)
+		return
+	}
+
+	if err := c.bw.Flush(); err != nil || ctx.Request.Close {
+		c.closing.Store(true)
+	}
+}
+
+// Sends 100 Continue the first time the handler reads the body of a request
+// sent with Expect: 100-continue. Until then, the client holds the body back.
+type expectContinueReader struct {
+	w    *ResponseWriter
+	r    io.Reader
+	sent bool
+}
+
+func (ecr *expectContinueReader) Read(p []byte) (int, error) {
+	if !ecr.sent {
+		ecr.sent = true
+		// Too late if the final response is already on its way
+		if !ecr.w.sentHeader {
+			ecr.w.bw.WriteString("HTTP/1.1 100 Continue\r\n\r\n")
+			if err := ecr.w.bw.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return ecr.r.Read(p)
+}
+
+// Sets up the handling of the Expect header. Only 100-continue is
+// supported, other expectations can't be met, see RFC 9110, 10.1.1.
+// Handlers that respond without reading the body reject it.
+func (c *Context) handleExpect() bool {
+	expect := c.Request.Headers.Get("Expect")
+	if expect == "" || !c.Request.ProtoAtLeast(1, 1) {
+		return true
+	}
+
+	if !strings.EqualFold(expect, "100-continue") {
+		return false
+	}
+
+	if c.Request.Body != parser.NoBody {
+		ecr := &expectContinueReader{w: &c.Response, r: c.Request.Body}
+		c.Request.Body = ecr
+		c.Response.continueReader = ecr
+	}
+
+	return true
+}
+
+// Discards what the handler left of the request body, so that the next
+// request can be read from the connection. If more than limit bytes are
+// left, the connection is closed instead.
+func (c *Context) discardBody(limit int64) {
+	body := c.Request.Body
+	if ecr, ok := body.(*expectContinueReader); ok {
+		if !ecr.sent {
+			// The client never got to send the body, the connection is
+			// closed by the ResponseWriter.
+			return
+		}
+		body = ecr.r
+	}
+
+	if body == nil || body == parser.NoBody {
+		return
+	}
+
+	_, err := io.CopyN(io.Discard, body, limit+1)
+	if err != io.EOF {
+		c.Request.Close = true
+	}
+}
+
+// Errors caused by the peer going away or the socket failing, as opposed to
+// a malformed request. There is nobody left to answer in these cases.
+// net.Error isn't enough to tell, since *url.Error implements it too.
+func isConnError(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &opErr)
+}
+
+// Returned when reading past the limit of a MaxBytesReader
+type MaxBytesError struct {
+	Limit int64
+}
+
+func (e *MaxBytesError) Error() string {
+	return "http: request body too large"
+}
+
+// Limits the request body r to n bytes. Reads past the limit fail with a
+// *MaxBytesError, and the connection is closed after the response since the
+// rest of the body is never read.
+func MaxBytesReader(c *Context, r io.Reader, n int64) io.Reader {
+	return newMaxBytesReader(c, r, n)
+}
+
+type maxBytesReader struct {
+	c     *Context
+	r     io.Reader
+	n     int64 // Bytes left before the limit
+	limit int64
+	err   error // Sticky error
+}
+
+func newMaxBytesReader(c *Context, r io.Reader, n int64) *maxBytesReader {
+	return &maxBytesReader{c: c, r: r, n: n, limit: n}
+}
+
+func (l *maxBytesReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Read one byte past the limit, to tell whether the body ends right at it
+	if int64(len(p))-1 > l.n {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	if int64(n) <= l.n {
+		l.n -= int64(n)
+		l.err = err
+		return n, err
+	}
+
+	n = int(l.n)
+	l.n = 0
+	l.err = &MaxBytesError{Limit: l.limit}
+	l.c.Request.Close = true
+	return n, l.err
+}
+
+// Answers a request that could not be read. The connection is closed
+// afterwards, since we can't know where the next request begins.
+func writeError(conn net.Conn, code int, detail string) {
+	body := status.Text(code)
+	if detail != "" {
+		body += ": " + detail
+	}
+
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: %d\r\n"+
+		"Connection: close\r\n"+
+		"\r\n"+
+		"%s", code, status.Text(code), len(body), body)
+}
+
+func notFound(c *Context) {
+	c.WriteHeader(status.NotFound)
+	c.WriteString(status.Text(status.NotFound))
+}
@@ -0,0 +1,446 @@
+package context_test
+
+import (
+	"bufio"
+	gocontext "context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arthur-teixeira/go-http/context"
+	"github.com/arthur-teixeira/go-http/status"
+	"github.com/stretchr/testify/assert"
+)
+
+func startServer(t *testing.T, s *context.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { l.Close() })
+
+	return l.Addr().String()
+}
+
+// Sends a raw request and returns everything the server wrote until it
+// closed the connection.
+func roundTrip(t *testing.T, addr string, request string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := io.ReadAll(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(res)
+}
+
+func TestServerHandler(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			c.WriteHeader(status.Created)
+			c.WriteString("path=" + c.Request.URL.Path)
+		}),
+	})
+
+	res := roundTrip(t, addr, "GET /hello HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 201 Created\r\n"), res)
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\npath=/hello"), res)
+}
+
+func TestServerBadRequest(t *testing.T) {
+	called := false
+	addr := startServer(t, &context.Server{
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			called = true
+		}),
+	})
+
+	for _, req := range []string{
+		"GARBAGE\r\n\r\n",
+		// Malformed request targets
+		"GET %zz HTTP/1.1\r\nHost: test\r\n\r\n",
+		"GET http://[::1 HTTP/1.1\r\nHost: test\r\n\r\n",
+	} {
+		res := roundTrip(t, addr, req)
+		assert.False(t, called)
+		assert.True(t, strings.HasPrefix(res, "HTTP/1.1 400 Bad Request\r\n"), res)
+		assert.Contains(t, res, "Connection: close\r\n")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	started := make(chan struct{})
+	s := &context.Server{
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			if c.Request.URL.Path == "/slow" {
+				close(started)
+				time.Sleep(100 * time.Millisecond)
+			}
+			c.WriteString("done")
+		}),
+	}
+	hookCalled := make(chan struct{})
+	s.RegisterOnShutdown(func() { close(hookCalled) })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+
+	// An idle keep-alive connection should be closed right away
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	br := bufio.NewReader(idle)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	br.Discard(len("done"))
+
+	// A new connection gets to send its request
+	fresh, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+
+	res := make(chan string, 1)
+	go func() {
+		res <- roundTrip(t, l.Addr().String(), "GET /slow HTTP/1.1\r\nHost: test\r\n\r\n")
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(gocontext.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+
+	fresh.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	out, _ := io.ReadAll(fresh)
+	assert.True(t, strings.HasSuffix(string(out), "done"), string(out))
+	assert.Contains(t, string(out), "Connection: close\r\n")
+
+	assert.Nil(t, <-shutdown)
+	assert.ErrorIs(t, <-served, context.ErrServerClosed)
+	<-hookCalled
+
+	out2 := <-res
+	assert.True(t, strings.HasSuffix(out2, "done"), out2)
+	assert.Contains(t, out2, "Connection: close\r\n")
+
+	n, _ := br.Read(make([]byte, 1))
+	assert.Equal(t, 0, n)
+}
+
+func TestServerTimeouts(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		ReadHeaderTimeout: 50 * time.Millisecond,
+		IdleTimeout:       50 * time.Millisecond,
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			c.WriteString("ok")
+		}),
+	})
+
+	// Headers never finish
+	res := roundTrip(t, addr, "GET / HTTP/1.1\r\nHost: te")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 408 Request Timeout\r\n"), res)
+
+	// Idle connection is closed after answering the first request
+	start := time.Now()
+	res = roundTrip(t, addr, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	assert.True(t, strings.HasSuffix(res, "ok"), res)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestServerIdleTimeoutOnly(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		IdleTimeout: 50 * time.Millisecond,
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			c.WriteString("ok")
+		}),
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	br.Discard(2)
+
+	// The idle timeout ends once the next request starts, and there is no
+	// limit on reading its headers
+	conn.Write([]byte("G"))
+	time.Sleep(100 * time.Millisecond)
+	conn.Write([]byte("ET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"))
+
+	res, _ := io.ReadAll(br)
+	assert.True(t, strings.HasPrefix(string(res), "HTTP/1.1 200 OK\r\n"), string(res))
+}
+
+func TestServerStreaming(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			c.WriteString("hello ")
+			c.Flush()
+			c.WriteString("world")
+		}),
+	})
+
+	res := roundTrip(t, addr, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, res, "Transfer-Encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\n6\r\nhello \r\n5\r\nworld\r\n0\r\n\r\n"), res)
+
+	// HTTP/1.0 clients get the body delimited by the connection closing
+	res = roundTrip(t, addr, "GET / HTTP/1.0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.0 200 OK\r\n"), res)
+	assert.Contains(t, res, "Connection: close\r\n")
+	assert.NotContains(t, res, "Transfer-Encoding")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nhello world"), res)
+}
+
+func TestServerBufferedResponse(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			c.WriteString("hello ")
+			c.WriteString("world")
+		}),
+	})
+
+	// Both responses on the same connection have a Content-Length
+	res := roundTrip(t, addr, "GET / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 2, strings.Count(res, "Content-Length: 11\r\n"), res)
+	assert.Equal(t, 2, strings.Count(res, "hello world"), res)
+}
+
+func TestServerResponseHeaders(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		Name: "go-http",
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			c.Header("X-Custom", "yes")
+			c.WriteHeader(status.OK)
+			c.Header("X-Late", "ignored")
+			c.Response.Headers.Set("X-Later", "ignored")
+			c.WriteString("<html><body>hi</body></html>")
+		}),
+	})
+
+	res := roundTrip(t, addr, "GET / HTTP/1.1\r\nX-Request-Only: 1\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, res, "X-Custom: yes\r\n")
+	assert.Contains(t, res, "Server: go-http\r\n")
+	assert.Contains(t, res, "Content-Type: text/html; charset=utf-8\r\n")
+	assert.Contains(t, res, "Date: ")
+	assert.NotContains(t, res, "X-Late")
+	assert.NotContains(t, res, "X-Later")
+	assert.NotContains(t, res, "X-Request-Only")
+
+	// The body outgrows the buffer on the first write
+	addr = startServer(t, &context.Server{
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			c.WriteString("<html>" + strings.Repeat("a", 3000))
+		}),
+	})
+	res = roundTrip(t, addr, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, res, "Transfer-Encoding: chunked\r\n")
+	assert.Contains(t, res, "Content-Type: text/html; charset=utf-8\r\n")
+}
+
+func TestServerExpectContinue(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			body, _ := io.ReadAll(c.Request.Body)
+			c.WriteString("got " + string(body))
+		}),
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 4\r\nExpect: 100-continue\r\nConnection: close\r\n\r\n"))
+
+	br := bufio.NewReader(conn)
+	line, _ := br.ReadString('\n')
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+	line, _ = br.ReadString('\n')
+	assert.Equal(t, "\r\n", line)
+
+	conn.Write([]byte("body"))
+	res, _ := io.ReadAll(br)
+	assert.True(t, strings.HasPrefix(string(res), "HTTP/1.1 200 OK\r\n"), string(res))
+	assert.True(t, strings.HasSuffix(string(res), "got body"), string(res))
+
+	res2 := roundTrip(t, addr, "POST / HTTP/1.1\r\nContent-Length: 4\r\nExpect: something\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res2, "HTTP/1.1 417 Expectation Failed\r\n"), res2)
+}
+
+func TestServerDiscardsUnreadBody(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		MaxDrainBytes: 16,
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			c.WriteString("ignored body")
+		}),
+	})
+
+	res := roundTrip(t, addr, "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123456789"+
+		"GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 2, strings.Count(res, "HTTP/1.1 200 OK\r\n"), res)
+
+	// Too much left over, the connection is closed after the first response
+	res = roundTrip(t, addr, "POST / HTTP/1.1\r\nContent-Length: 100\r\n\r\n"+strings.Repeat("x", 100)+
+		"GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 1, strings.Count(res, "HTTP/1.1 200 OK\r\n"), res)
+	assert.Contains(t, res, "Connection: close\r\n")
+}
+
+func TestServerPipelining(t *testing.T) {
+	fastDone := make(chan struct{})
+	addr := startServer(t, &context.Server{
+		ConcurrentPipelining: true,
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			switch c.Request.URL.Path {
+			case "/slow":
+				// Only finishes in time if /fast runs concurrently
+				select {
+				case <-fastDone:
+					c.WriteString("slow-concurrent")
+				case <-time.After(2 * time.Second):
+					c.WriteString("slow-sequential")
+				}
+			case "/fast":
+				close(fastDone)
+				c.WriteString("fast")
+			default:
+				c.WriteString("last")
+			}
+		}),
+	})
+
+	res := roundTrip(t, addr, "GET /slow HTTP/1.1\r\n\r\nGET /fast HTTP/1.1\r\n\r\n"+
+		"GET /last HTTP/1.1\r\nConnection: close\r\n\r\n")
+	slow := strings.Index(res, "slow-concurrent")
+	fast := strings.Index(res, "fast")
+	last := strings.Index(res, "last")
+	assert.True(t, slow >= 0 && slow < fast && fast < last, res)
+	assert.Equal(t, 3, strings.Count(res, "HTTP/1.1 200 OK\r\n"), res)
+}
+
+func TestServerRequestLimits(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		MaxRequestLineLength: 64,
+		MaxHeaderBytes:       128,
+		MaxHeaderCount:       4,
+		MaxBodyBytes:         8,
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			body, err := io.ReadAll(c.Request.Body)
+			if err != nil || c.Request.URL.Path == "/silent" {
+				return
+			}
+			c.WriteString("got " + string(body))
+		}),
+	})
+
+	res := roundTrip(t, addr, "GET /"+strings.Repeat("a", 64)+" HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 414 Request URI Too Long\r\n"), res)
+
+	res = roundTrip(t, addr, "GET / HTTP/1.1\r\nX-Big: "+strings.Repeat("a", 128)+"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 431 Request Header Fields Too Large\r\n"), res)
+
+	res = roundTrip(t, addr, "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\nE: 5\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 431 Request Header Fields Too Large\r\n"), res)
+
+	res = roundTrip(t, addr, "POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n123456789")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 413 Request Entity Too Large\r\n"), res)
+
+	// Chunked bodies are only found to be too large while reading them
+	res = roundTrip(t, addr, "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n9\r\n123456789\r\n0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 413 Request Entity Too Large\r\n"), res)
+	assert.Contains(t, res, "Connection: close\r\n")
+
+	res = roundTrip(t, addr, "POST / HTTP/1.1\r\nContent-Length: 8\r\nConnection: close\r\n\r\n12345678")
+	assert.True(t, strings.HasSuffix(res, "got 12345678"), res)
+
+	// A body within the limit that was read whole isn't an error
+	res = roundTrip(t, addr, "POST /silent HTTP/1.1\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"), res)
+}
+
+func TestServerStrictParsing(t *testing.T) {
+	called := false
+	addr := startServer(t, &context.Server{
+		StrictParsing: true,
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			called = true
+		}),
+	})
+
+	res := roundTrip(t, addr, "POST / HTTP/1.1\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"0\r\n\r\nGET /smuggled HTTP/1.1\r\n\r\n")
+	assert.False(t, called)
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 400 Bad Request\r\n"), res)
+	assert.Contains(t, res, "Connection: close\r\n")
+	assert.Equal(t, 1, strings.Count(res, "HTTP/1.1"), res)
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	addr := startServer(t, &context.Server{
+		IdleTimeout: 5 * time.Second,
+		Handler: context.HandlerFunc(func(c *context.Context) {
+			if c.Request.URL.Path == "/bye" {
+				c.Response.Headers.Set("Connection", "close")
+			}
+			c.WriteString("ok")
+		}),
+	})
+
+	// HTTP/1.0 connections close unless keep-alive is asked for
+	res := roundTrip(t, addr, "GET / HTTP/1.0\r\n\r\n")
+	assert.Contains(t, res, "Connection: close\r\n")
+	assert.NotContains(t, res, "Keep-Alive")
+
+	res = roundTrip(t, addr, "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"+
+		"GET / HTTP/1.0\r\n\r\n")
+	first, second, _ := strings.Cut(res, "okHTTP/1.0")
+	assert.Contains(t, first, "Connection: keep-alive\r\n")
+	assert.Contains(t, first, "Keep-Alive: timeout=5\r\n")
+	assert.Contains(t, second, "Connection: close\r\n")
+
+	// The handler can close the connection
+	res = roundTrip(t, addr, "GET /bye HTTP/1.1\r\nHost: test\r\n\r\n")
+	assert.Equal(t, 1, strings.Count(res, "Connection: close\r\n"), res)
+	assert.NotContains(t, res, "Keep-Alive")
+}
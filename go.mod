@@ -2,11 +2,14 @@ module github.com/arthur-teixeira/go-http
 
 go 1.22.1
 
+require (
+	github.com/stretchr/testify v1.10.0
+	golang.org/x/net v0.34.0
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.10.0 // indirect
-	golang.org/x/net v0.34.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -4,10 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net"
-	"net/url"
 	"sync"
 	"time"
 
@@ -39,55 +36,21 @@ func main() {
 }
 
 func call() (*parser.Response, error) {
-	url, err := url.ParseRequestURI("http://google.com")
+	req, err := parser.NewRequest("GET", "http://google.com", nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	return context.DefaultClient.Do(&parser.Request{
-		URL:     url,
-		Method:  "GET",
-		Version: "HTTP/1.1",
-		Major:   1,
-		Minor:   1,
-	})
-
+	return context.DefaultClient.Do(req)
 }
 
-func listenAndServe(addr string) error {
-	sock, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
-	}
-
-	for {
-		conn, err := sock.Accept()
-		if err != nil {
-			log.Println("Error accepting connection: ", err)
-			continue
-		}
-
-		go handleConnection(conn)
+func serve(addr string) error {
+	s := &context.Server{
+		Addr:    addr,
+		Handler: context.Chain(context.HandlerFunc(handleRequest), context.Recovery(), context.Logger()),
 	}
-}
 
-func handleConnection(conn net.Conn) {
-	// TODO: Create timeout for persistent connections
-	for {
-		context, err := context.NewContext(conn)
-		if err != nil {
-			if err == io.EOF {
-				continue
-			}
-			log.Println("Error building context: ", err)
-		}
-
-		handleRequest(context)
-		if context.Request.Close {
-			conn.Close()
-			break
-		}
-	}
+	return s.ListenAndServe()
 }
 
 func handleRequest(c *context.Context) {
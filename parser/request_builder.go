@@ -0,0 +1,182 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+)
+
+func NewRequest(method, rawURL string, body io.Reader) (*Request, error) {
+	return NewRequestWithContext(context.Background(), method, rawURL, body)
+}
+
+// Returns an HTTP/1.1 request for rawURL. For bodies of type *bytes.Buffer,
+// *bytes.Reader and *strings.Reader, ContentLength is set and ReadBody
+// returns a copy of the body, so that it can be sent again on redirects.
+// Other bodies have an unknown length. An empty method means GET.
+func NewRequestWithContext(ctx context.Context, method, rawURL string, body io.Reader) (*Request, error) {
+	if ctx == nil {
+		return nil, errors.New("http: nil Context")
+	}
+
+	if method == "" {
+		method = "GET"
+	}
+	if !ValidMethod(method) {
+		return nil, StringError("Invalid method", method)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Request{
+		Ctx:     ctx,
+		Method:  method,
+		URL:     u,
+		Version: "HTTP/1.1",
+		Major:   1,
+		Minor:   1,
+		Headers: make(Headers),
+		Host:    u.Host,
+		Body:    body,
+	}
+
+	switch v := body.(type) {
+	case nil:
+		r.Body = NoBody
+	case *bytes.Buffer:
+		buf := v.Bytes()
+		r.ContentLength = int64(len(buf))
+		r.ReadBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(buf)), nil
+		}
+	case *bytes.Reader:
+		snapshot := *v
+		r.ContentLength = int64(v.Len())
+		r.ReadBody = func() (io.ReadCloser, error) {
+			rd := snapshot
+			return io.NopCloser(&rd), nil
+		}
+	case *strings.Reader:
+		snapshot := *v
+		r.ContentLength = int64(v.Len())
+		r.ReadBody = func() (io.ReadCloser, error) {
+			rd := snapshot
+			return io.NopCloser(&rd), nil
+		}
+	default:
+		if body != NoBody {
+			r.ContentLength = -1
+		}
+	}
+
+	if r.ContentLength == 0 {
+		r.Body = NoBody
+		r.ReadBody = func() (io.ReadCloser, error) { return NoBody, nil }
+	}
+
+	return r, nil
+}
+
+// Builds a request step by step, e.g.
+//
+//	req, err := parser.NewRequestBuilder("POST", "http://example.com/items").
+//		Query("page", "2").
+//		Header("Accept", "application/json").
+//		JSON(item).
+//		Build()
+//
+// The first error is kept and returned by Build.
+type RequestBuilder struct {
+	ctx     context.Context
+	method  string
+	rawURL  string
+	query   url.Values
+	headers Headers
+	body    io.Reader
+	err     error
+}
+
+func NewRequestBuilder(method, rawURL string) *RequestBuilder {
+	return &RequestBuilder{
+		ctx:     context.Background(),
+		method:  method,
+		rawURL:  rawURL,
+		query:   make(url.Values),
+		headers: make(Headers),
+	}
+}
+
+func (b *RequestBuilder) Context(ctx context.Context) *RequestBuilder {
+	b.ctx = ctx
+	return b
+}
+
+// Adds a query parameter to the ones already in the URL
+func (b *RequestBuilder) Query(key, value string) *RequestBuilder {
+	b.query.Add(key, value)
+	return b
+}
+
+func (b *RequestBuilder) Header(key, value string) *RequestBuilder {
+	b.headers.Add(key, value)
+	return b
+}
+
+func (b *RequestBuilder) Body(body io.Reader) *RequestBuilder {
+	b.body = body
+	return b
+}
+
+// Sets the body to v encoded as JSON
+func (b *RequestBuilder) JSON(v any) *RequestBuilder {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+		return b
+	}
+
+	b.headers.Set("Content-Type", "application/json")
+	b.body = bytes.NewReader(buf)
+	return b
+}
+
+// Sets the body to the URL encoded form values
+func (b *RequestBuilder) Form(values url.Values) *RequestBuilder {
+	b.headers.Set("Content-Type", "application/x-www-form-urlencoded")
+	b.body = strings.NewReader(values.Encode())
+	return b
+}
+
+func (b *RequestBuilder) Build() (*Request, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	r, err := NewRequestWithContext(b.ctx, b.method, b.rawURL, b.body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b.query) > 0 {
+		q := r.URL.Query()
+		for k, vv := range b.query {
+			q[k] = append(q[k], vv...)
+		}
+		r.URL.RawQuery = q.Encode()
+	}
+
+	for k, vv := range b.headers {
+		r.Headers[k] = append(r.Headers[k], vv...)
+	}
+
+	return r, nil
+}
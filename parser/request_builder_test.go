@@ -0,0 +1,69 @@
+package parser_test
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/arthur-teixeira/go-http/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRequest(t *testing.T) {
+	r, err := parser.NewRequest("POST", "http://example.com/path", strings.NewReader("body"))
+	assert.Nil(t, err)
+	assert.Equal(t, "POST", r.Method)
+	assert.Equal(t, "example.com", r.Host)
+	assert.True(t, r.ProtoAtLeast(1, 1))
+	assert.NotNil(t, r.Headers)
+	assert.Equal(t, int64(4), r.ContentLength)
+
+	// The body can be read again for redirects
+	body, _ := io.ReadAll(r.Body)
+	assert.Equal(t, "body", string(body))
+	rc, err := r.ReadBody()
+	assert.Nil(t, err)
+	body, _ = io.ReadAll(rc)
+	assert.Equal(t, "body", string(body))
+
+	r, err = parser.NewRequest("", "http://example.com", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "GET", r.Method)
+	assert.Equal(t, parser.NoBody, r.Body)
+
+	r, err = parser.NewRequest("PUT", "http://example.com", io.MultiReader(bytes.NewReader([]byte("x"))))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-1), r.ContentLength)
+	assert.Nil(t, r.ReadBody)
+
+	_, err = parser.NewRequest("BAD METHOD", "http://example.com", nil)
+	assert.NotNil(t, err)
+}
+
+func TestRequestBuilder(t *testing.T) {
+	r, err := parser.NewRequestBuilder("POST", "http://example.com/items?a=1").
+		Query("b", "2").
+		Header("Accept", "application/json").
+		JSON(map[string]int{"n": 1}).
+		Build()
+	assert.Nil(t, err)
+	assert.Equal(t, "a=1&b=2", r.URL.RawQuery)
+	assert.Equal(t, "application/json", r.Headers.Get("Accept"))
+	assert.Equal(t, "application/json", r.Headers.Get("Content-Type"))
+	body, _ := io.ReadAll(r.Body)
+	assert.Equal(t, `{"n":1}`, string(body))
+	assert.Equal(t, int64(len(body)), r.ContentLength)
+
+	r, err = parser.NewRequestBuilder("POST", "http://example.com").
+		Form(url.Values{"name": {"go http"}}).
+		Build()
+	assert.Nil(t, err)
+	assert.Equal(t, "application/x-www-form-urlencoded", r.Headers.Get("Content-Type"))
+	body, _ = io.ReadAll(r.Body)
+	assert.Equal(t, "name=go+http", string(body))
+
+	_, err = parser.NewRequestBuilder("POST", "http://example.com").JSON(func() {}).Build()
+	assert.NotNil(t, err)
+}
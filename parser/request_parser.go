@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/arthur-teixeira/go-http/chunkedreader"
 	"github.com/arthur-teixeira/go-http/textreader"
@@ -42,6 +43,19 @@ func (h Headers) Set(k string, v string) {
 	h[kk] = []string{v}
 }
 
+func (h Headers) Clone() Headers {
+	if h == nil {
+		return nil
+	}
+
+	clone := make(Headers, len(h))
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+
+	return clone
+}
+
 func StringError(what, how string) error {
 	return fmt.Errorf("%s %q", what, how)
 }
@@ -74,7 +88,7 @@ func (r *Request) Context() context.Context {
 }
 
 func (r Request) ProtoAtLeast(maj int, min int) bool {
-	return maj > r.Major || (maj == r.Major && min >= r.Minor)
+	return r.Major > maj || (r.Major == maj && r.Minor >= min)
 }
 
 // Copyright 2009 The Go Authors.
@@ -168,7 +182,9 @@ func isNotToken(r rune) bool {
 	return !IsTokenRune(r)
 }
 
-func isValidMethod(method string) bool {
+// Reports whether method is a token, which is all a method has to be, see
+// RFC 9110, 9.1. Extension methods like PATCH are allowed.
+func ValidMethod(method string) bool {
 	return len(method) > 0 && strings.IndexFunc(method, isNotToken) == -1
 }
 
@@ -200,11 +216,59 @@ func ParseHttpVersion(version string) (major, minor int, ok bool) {
 	return int(maj), int(minv), true
 }
 
+var (
+	ErrRequestLineTooLong = errors.New("Request line too long")
+	ErrHeadersTooLarge    = errors.New("Request header fields too large")
+)
+
+// A request that is rejected by the strict validation, as its framing
+// could be understood differently by other servers on the way.
+type ProtocolError struct {
+	ErrorString string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.ErrorString
+}
+
+var (
+	ErrBareLF                = &ProtocolError{"Line ending without CR"}
+	ErrLengthAndEncoding     = &ProtocolError{"Request has both Content-Length and Transfer-Encoding"}
+	ErrWhitespaceBeforeColon = &ProtocolError{"Whitespace between header name and colon"}
+	ErrInvalidHeaderName     = &ProtocolError{"Invalid header name"}
+	ErrInvalidHeaderValue    = &ProtocolError{"Invalid header value"}
+	ErrDuplicateHost         = &ProtocolError{"Request has multiple Host headers"}
+)
+
+// Limits on the size of a request head. Zero values mean no limit.
+type RequestOptions struct {
+	MaxRequestLineLength int
+	MaxHeaderBytes       int // Size of all header lines, without line endings
+	MaxHeaderCount       int
+	// Reject requests that are ambiguous or malformed, instead of
+	// interpreting them leniently. Errors are *ProtocolError.
+	Strict bool
+}
+
 func ParseRequest(request *bufio.Reader, conn transport.Reusable) (*Request, error) {
+	return ParseRequestOptions(request, conn, RequestOptions{})
+}
+
+// Parses a request, failing with ErrRequestLineTooLong or ErrHeadersTooLarge
+// when the request goes over the limits in opts.
+func ParseRequestOptions(request *bufio.Reader, conn transport.Reusable, opts RequestOptions) (*Request, error) {
 	tr := textreader.NewTextReader(request)
 	defer textreader.PutTextReader(tr)
 
+	tr.MaxLineLength = opts.MaxRequestLineLength
+	tr.Strict = opts.Strict
 	line, err := tr.ReadLine()
+	if errors.Is(err, textreader.ErrLineTooLong) {
+		return nil, ErrRequestLineTooLong
+	}
+	if errors.Is(err, textreader.ErrBareLF) {
+		return nil, ErrBareLF
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -242,25 +306,75 @@ func ParseRequest(request *bufio.Reader, conn transport.Reusable) (*Request, err
 		r.URL.Scheme = ""
 	}
 
+	tr.MaxLineLength = 0
+	tr.MaxHeaderBytes = opts.MaxHeaderBytes
+	tr.MaxHeaderCount = opts.MaxHeaderCount
 	headers, err := tr.ReadHeaders()
+	if errors.Is(err, textreader.ErrHeadersTooLarge) || errors.Is(err, textreader.ErrTooManyHeaders) {
+		return nil, ErrHeadersTooLarge
+	}
+	if errors.Is(err, textreader.ErrBareLF) {
+		return nil, ErrBareLF
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	r.Headers = Headers(headers)
+	if opts.Strict {
+		if err := validateHeaders(r.Headers); err != nil {
+			return nil, err
+		}
+	}
+
 	r.Host = r.URL.Host
 	if r.Host == "" {
 		r.Host = r.Headers.Get("Host")
 	}
+	r.setClose()
 	err = setBody(&r, request, conn)
 	if err != nil {
 		return nil, err
 	}
-	r.setClose()
 
 	return &r, nil
 }
 
+func isNotValueRune(r rune) bool {
+	return (r < ' ' && r != '\t') || r == 0x7f
+}
+
+// Checks the headers of a request in strict mode. A Content-Length next to
+// Transfer-Encoding is a sign of request smuggling rather than something to
+// resolve, see RFC 9112, 6.3.
+func validateHeaders(h Headers) error {
+	for k, vv := range h {
+		if strings.TrimRight(k, " \t") != k {
+			return fmt.Errorf("%w: %q", ErrWhitespaceBeforeColon, k)
+		}
+
+		if k == "" || strings.IndexFunc(k, isNotToken) != -1 {
+			return fmt.Errorf("%w: %q", ErrInvalidHeaderName, k)
+		}
+
+		for _, v := range vv {
+			if strings.IndexFunc(v, isNotValueRune) != -1 {
+				return fmt.Errorf("%w: %q", ErrInvalidHeaderValue, k)
+			}
+		}
+	}
+
+	if len(h["Host"]) > 1 {
+		return ErrDuplicateHost
+	}
+
+	if _, ok := h["Transfer-Encoding"]; ok && len(h["Content-Length"]) > 0 {
+		return ErrLengthAndEncoding
+	}
+
+	return nil
+}
+
 var NoBody = noBody{}
 
 type noBody struct{}
@@ -269,6 +383,9 @@ func (noBody) Read([]byte) (int, error)         { return 0, io.EOF }
 func (noBody) Close() error                     { return nil }
 func (noBody) WriteTo(io.Writer) (int64, error) { return 0, nil }
 
+// Sets the framing announced by Transfer-Encoding. Only chunked is
+// supported as a coding, and it must be the final one. See RFC 9112, 6.1
+// and 6.3.
 func parseTransferCoding(r *Transfer) error {
 	val, ok := r.Headers["Transfer-Encoding"]
 	if !ok {
@@ -276,16 +393,38 @@ func parseTransferCoding(r *Transfer) error {
 	}
 	delete(r.Headers, "Transfer-Encoding")
 
-	// Chunked transfer is not supported in HTTP/1.0
+	// Transfer-Encoding only exists since HTTP/1.1, so the framing of an
+	// HTTP/1.0 message that has it can't be trusted.
 	if !r.ProtoAtLeast(1, 1) {
+		if r.IsRequest {
+			return errors.New("Transfer-Encoding in HTTP/1.0 request")
+		}
+		r.CloseDelimited = true
 		return nil
 	}
 
-	if len(val) > 1 {
-		return errors.New("Too many values for Transfer-Encoding")
+	var codings []string
+	for _, v := range val {
+		forEachHeaderElement(v, func(coding string) {
+			codings = append(codings, strings.ToLower(coding))
+		})
+	}
+
+	if len(codings) == 0 {
+		return errors.New("Empty Transfer-Encoding")
 	}
 
-	if !strings.EqualFold(val[0], "chunked") {
+	// When chunked isn't the final coding, a response ends when the
+	// connection closes, and the length of a request can't be determined.
+	if codings[len(codings)-1] != "chunked" {
+		if r.IsRequest {
+			return errors.New("Transfer-Encoding of request doesn't end in chunked")
+		}
+		r.CloseDelimited = true
+		return nil
+	}
+
+	if len(codings) > 1 {
 		return errors.New("Unsupported transfer encoding")
 	}
 
@@ -294,37 +433,121 @@ func parseTransferCoding(r *Transfer) error {
 }
 
 type Transfer struct {
-	Body          io.ReadCloser
-	Trailer       Headers
-	Headers       Headers
-	ContentLength int64
-	Major         int
-	Minor         int
-	Version       string
-	Chunked       bool
+	Body           io.ReadCloser
+	Trailer        Headers
+	Headers        Headers
+	ContentLength  int64
+	Major          int
+	Minor          int
+	Version        string
+	Chunked        bool
+	NoBody         bool // The message can't have a body whatever its headers say
+	CloseDelimited bool // The body ends when the connection is closed
+	IsRequest      bool
+	Interim        bool  // 1xx response
+	Close          *bool // Close flag of the message
 }
 
 func (t *Transfer) ProtoAtLeast(maj int, min int) bool {
-	return maj > t.Major || (maj == t.Major && min >= t.Minor)
+	return t.Major > maj || (t.Major == maj && t.Minor >= min)
+}
+
+// Hands back the connection of a message without a body, closing it if the
+// message asked for it
+func (t *Transfer) done(src transport.Reusable) {
+	if src == nil {
+		return
+	}
+
+	if t.Close != nil && *t.Close {
+		src.Close()
+		return
+	}
+
+	src.Release()
 }
 
 type body struct {
-	conn transport.Reusable
-	src  io.Reader
+	conn           transport.Reusable
+	src            io.Reader
+	closeDelimited bool   // The connection can't be reused once the body is read
+	closeConn      *bool  // Close flag of the message, checked when the body is closed
+	onEOF          func() // Called once the whole body was read
+	sawEOF         bool
+	closed         bool
 }
 
+var ErrBodyReadAfterClose = errors.New("http: invalid Read on closed Body")
+
 func (b *body) Read(buf []byte) (int, error) {
-	return b.src.Read(buf)
+	if b.closed {
+		return 0, ErrBodyReadAfterClose
+	}
+
+	n, err := b.src.Read(buf)
+	if err == io.EOF {
+		b.sawEOF = true
+		if b.onEOF != nil {
+			b.onEOF()
+			b.onEOF = nil
+		}
+	}
+
+	return n, err
+}
+
+// Reports whether the whole body was read, so that the next message on the
+// connection starts right after it
+func (b *body) done() bool {
+	if b.sawEOF {
+		return true
+	}
+
+	lr, ok := b.src.(*io.LimitedReader)
+	return ok && lr.N == 0
 }
 
+// Hands the connection back once the body is read. What's left of the body
+// is read first, within the limits of the connection, so the next response
+// can be read from it. Otherwise, the connection is closed.
 func (b *body) Close() error {
-	// TODO: Read body to end and buffer
+	// Request bodies read by the server, which discards what the handler
+	// left itself
+	if b.conn == nil || b.closed {
+		return nil
+	}
+
+	reuse := !b.closeDelimited && (b.closeConn == nil || !*b.closeConn) && (b.done() || b.drain())
+	b.closed = true
+	if !reuse {
+		return b.conn.Close()
+	}
 
-	// Should release underlying connection back to the conn manager
 	b.conn.Release()
 	return nil
 }
 
+// Reads the rest of the body, reporting whether it all was read
+func (b *body) drain() bool {
+	// Connections that don't implement transport.Drainer get the default
+	// limit, and no timeout
+	maxBytes, timeout := int64(transport.DefaultMaxDrainBytes), time.Duration(0)
+	if d, ok := b.conn.(transport.Drainer); ok {
+		maxBytes, timeout = d.DrainLimits()
+	}
+	if maxBytes <= 0 {
+		return false
+	}
+
+	if dc, ok := b.conn.(interface{ SetReadDeadline(time.Time) error }); ok && timeout > 0 {
+		dc.SetReadDeadline(time.Now().Add(timeout))
+		defer dc.SetReadDeadline(time.Time{})
+	}
+
+	_, err := io.Copy(io.Discard, io.LimitReader(b, maxBytes))
+	return err == nil && b.done()
+}
+
 // takes in either *Request or *Response
 func setBody(r any, rdr *bufio.Reader, src transport.Reusable) error {
 	tr := Transfer{}
@@ -335,11 +558,18 @@ func setBody(r any, rdr *bufio.Reader, src transport.Reusable) error {
 		tr.Major = rr.Major
 		tr.Minor = rr.Minor
 		tr.Version = rr.Version
+		tr.IsRequest = true
+		tr.Close = &rr.Close
 	case *Response:
 		tr.Headers = rr.Headers
 		tr.Major = rr.Major
 		tr.Minor = rr.Minor
 		tr.Version = rr.Version
+		tr.Close = &rr.Close
+		tr.Interim = rr.StatusCode/100 == 1
+		tr.NoBody = rr.requestMethod == "HEAD" ||
+			(rr.requestMethod == "CONNECT" && rr.StatusCode/100 == 2) ||
+			!BodyAllowedForStatus(rr.StatusCode)
 	}
 
 	if err := parseTransferCoding(&tr); err != nil {
@@ -350,29 +580,50 @@ func setBody(r any, rdr *bufio.Reader, src transport.Reusable) error {
 	if err != nil {
 		return err
 	}
+	tr.ContentLength = cl
 
 	tr.Trailer, err = getTrailer(tr.Headers, tr.Chunked)
 	if err != nil {
 		return err
 	}
 
+	var chunked *chunkedreader.ChunkedReader
 	switch {
-	case tr.Chunked:
-		tr.Body = &body{src: chunkedreader.NewChunkedReader(rdr), conn: src}
-	case cl == 0:
-		src.Release()
+	case tr.NoBody:
+		// Interim responses are followed by the final one on the same
+		// connection, which stays in use until then
+		if !tr.Interim {
+			tr.done(src)
+		}
 		tr.Body = NoBody
+		tr.Chunked = false
+	case tr.Chunked:
+		chunked = chunkedreader.NewChunkedReader(rdr)
+		tr.Body = &body{src: chunked, conn: src, closeConn: tr.Close}
+	case cl > 0:
+		tr.Body = &body{src: io.LimitReader(rdr, cl), conn: src, closeConn: tr.Close}
+	case tr.CloseDelimited, cl < 0 && !tr.IsRequest:
+		// A response without a declared length ends when the server closes
+		// the connection.
+		tr.CloseDelimited = true
+		tr.Body = &body{src: rdr, conn: src, closeDelimited: true}
 	default:
-		tr.Body = &body{src: io.LimitReader(rdr, cl), conn: src}
+		// A request without a declared length has no body
+		tr.done(src)
+		tr.ContentLength = 0
+		tr.Body = NoBody
 	}
 
+	var trailer *Headers
 	switch rr := r.(type) {
 	case *Request:
+		trailer = &rr.Trailer
 		rr.Body = tr.Body
 		rr.Trailer = tr.Trailer
 		rr.Chunked = tr.Chunked
 		rr.ContentLength = tr.ContentLength
 	case *Response:
+		trailer = &rr.Trailer
 		rr.Body = tr.Body
 		rr.Trailer = tr.Trailer
 		rr.Chunked = tr.Chunked
@@ -380,11 +631,35 @@ func setBody(r any, rdr *bufio.Reader, src transport.Reusable) error {
 			rr.TransferCoding = "chunked"
 		}
 		rr.ContentLength = tr.ContentLength
+		rr.Close = rr.Close || tr.CloseDelimited
+	}
+
+	if chunked != nil {
+		tr.Body.(*body).onEOF = func() {
+			mergeTrailer(trailer, chunked.Trailer())
+		}
 	}
 
 	return nil
 }
 
+// Adds the trailer fields received after a chunked body to the ones
+// announced in the Trailer header. Fields that frame the message are not
+// allowed in a trailer, see RFC 9110, 6.5.1.
+func mergeTrailer(dst *Headers, src map[string][]string) {
+	for k, vv := range src {
+		switch k {
+		case "Transfer-Encoding", "Content-Length", "Trailer", "Host":
+			continue
+		}
+
+		if *dst == nil {
+			*dst = make(Headers)
+		}
+		(*dst)[k] = vv
+	}
+}
+
 func forEachHeaderElement(v string, cb func(string)) {
 	v = textproto.TrimString(v)
 	if v == "" {
@@ -440,7 +715,34 @@ func getTrailer(headers Headers, chunked bool) (Headers, error) {
 }
 
 func (r *Request) setClose() {
-	r.Close = strings.Contains(r.Headers.Get("Connection"), "close")
+	r.Close = shouldClose(r.Major, r.Minor, r.Headers)
+}
+
+// Reports whether the connection closes after a message, see RFC 9112, 9.3.
+// HTTP/1.1 connections persist unless Connection: close is sent, HTTP/1.0
+// ones only when Connection: keep-alive is.
+func shouldClose(major, minor int, h Headers) bool {
+	if major < 1 {
+		return true
+	}
+
+	var close, keepAlive bool
+	for _, v := range h["Connection"] {
+		forEachHeaderElement(v, func(opt string) {
+			switch strings.ToLower(opt) {
+			case "close":
+				close = true
+			case "keep-alive":
+				keepAlive = true
+			}
+		})
+	}
+
+	if close {
+		return true
+	}
+
+	return major == 1 && minor == 0 && !keepAlive
 }
 
 func GetContentLength(r *Transfer) (int64, error) {
@@ -471,7 +773,8 @@ func GetContentLength(r *Transfer) (int64, error) {
 		return -1, errors.New("Bad content length")
 	}
 
-	if r.Chunked {
+	// Transfer-Encoding overrides Content-Length, see RFC 9112, 6.3
+	if r.Chunked || r.CloseDelimited {
 		r.Headers.Del("Content-Length")
 		return -1, nil
 	}
@@ -2,6 +2,7 @@ package parser_test
 
 import (
 	"bufio"
+	"io"
 	"strings"
 	"testing"
 
@@ -33,7 +34,7 @@ func TestParser(t *testing.T) {
 			"\r\n" +
 			"field1=asfd&field2=a3f3f3\r\n"
 	rdr := makeReader(request)
-	r, err := parser.ParseRequest(rdr)
+	r, err := parser.ParseRequest(rdr, nil)
 
 	assert.Nil(t, err)
 	assert.Equal(t, r.Method, "POST")
@@ -71,7 +72,7 @@ func TestInvalidContentLength(t *testing.T) {
 		"\r\n" +
 		"InvalidBody"
 	reader := makeReader(request)
-	r, err := parser.ParseRequest(reader)
+	r, err := parser.ParseRequest(reader, nil)
 	assert.Nil(t, r)
 	assert.NotNil(t, err)
 
@@ -85,9 +86,121 @@ func TestMultiplecontentLengths(t *testing.T) {
 		"\r\n" +
 		"InvalidBody"
 	reader := makeReader(request)
-	r, err := parser.ParseRequest(reader)
+	r, err := parser.ParseRequest(reader, nil)
 	assert.Nil(t, r)
 	assert.NotNil(t, err)
 
 	assert.Equal(t, err.Error(), "Request has multiple content lengths")
 }
+
+func TestRequestWithoutLength(t *testing.T) {
+	request := "POST /test HTTP/1.1\r\n" +
+		"\r\n" +
+		"GET /next HTTP/1.1\r\n"
+	r, err := parser.ParseRequest(makeReader(request), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, r.Body, parser.NoBody)
+	assert.Equal(t, r.ContentLength, int64(0))
+}
+
+func TestRequestUndeterminedLength(t *testing.T) {
+	requests := []string{
+		"POST /test HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n",
+		"POST /test HTTP/1.1\r\nTransfer-Encoding: chunked, gzip\r\n\r\n",
+		"POST /test HTTP/1.0\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n",
+	}
+
+	for _, request := range requests {
+		r, err := parser.ParseRequest(makeReader(request), nil)
+		assert.Nil(t, r)
+		assert.NotNil(t, err, request)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	opts := parser.RequestOptions{
+		MaxRequestLineLength: 32,
+		MaxHeaderBytes:       64,
+		MaxHeaderCount:       3,
+	}
+
+	request := "GET /" + strings.Repeat("a", 32) + " HTTP/1.1\r\n\r\n"
+	_, err := parser.ParseRequestOptions(makeReader(request), nil, opts)
+	assert.ErrorIs(t, err, parser.ErrRequestLineTooLong)
+
+	request = "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", 64) + "\r\n\r\n"
+	_, err = parser.ParseRequestOptions(makeReader(request), nil, opts)
+	assert.ErrorIs(t, err, parser.ErrHeadersTooLarge)
+
+	request = "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n"
+	_, err = parser.ParseRequestOptions(makeReader(request), nil, opts)
+	assert.ErrorIs(t, err, parser.ErrHeadersTooLarge)
+
+	request = "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n"
+	r, err := parser.ParseRequestOptions(makeReader(request), nil, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, "3", r.Headers.Get("C"))
+}
+
+func TestStrictRequest(t *testing.T) {
+	opts := parser.RequestOptions{Strict: true}
+	requests := map[string]error{
+		"GET / HTTP/1.1\nHost: test\r\n\r\n":                                         parser.ErrBareLF,
+		"GET / HTTP/1.1\r\nHost: test\n\r\n":                                         parser.ErrBareLF,
+		"POST / HTTP/1.1\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n": parser.ErrLengthAndEncoding,
+		"GET / HTTP/1.1\r\nHost : test\r\n\r\n":                                      parser.ErrWhitespaceBeforeColon,
+		"GET / HTTP/1.1\r\nHo(st: test\r\n\r\n":                                      parser.ErrInvalidHeaderName,
+		"GET / HTTP/1.1\r\nHost: te\x00st\r\n\r\n":                                   parser.ErrInvalidHeaderValue,
+		"GET / HTTP/1.1\r\nHost: a\r\nhost: b\r\n\r\n":                               parser.ErrDuplicateHost,
+	}
+
+	for request, expected := range requests {
+		r, err := parser.ParseRequestOptions(makeReader(request), nil, opts)
+		assert.Nil(t, r)
+		assert.ErrorIs(t, err, expected, request)
+
+		var protoErr *parser.ProtocolError
+		assert.ErrorAs(t, err, &protoErr)
+	}
+
+	// Accepted when not strict
+	r, err := parser.ParseRequest(makeReader("GET / HTTP/1.1\nHost: test\n\n"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "test", r.Host)
+
+	r, err = parser.ParseRequestOptions(makeReader("GET / HTTP/1.1\r\nHost: test\r\nX-Tab: a\tb\r\n\r\n"), nil, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, "a\tb", r.Headers.Get("X-Tab"))
+}
+
+func TestRequestTrailer(t *testing.T) {
+	request := "POST /test HTTP/1.1\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"Trailer: Checksum, Expires\r\n" +
+		"\r\n" +
+		"4\r\nbody\r\n" +
+		"0\r\n" +
+		"Checksum: abc\r\n" +
+		"X-Extra: 1\r\n" +
+		"Content-Length: 10\r\n" +
+		"\r\n" +
+		"GET /next HTTP/1.1\r\n\r\n"
+	reader := makeReader(request)
+	r, err := parser.ParseRequest(reader, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, parser.Headers{"Checksum": nil, "Expires": nil}, r.Trailer)
+
+	body, err := io.ReadAll(r.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "body", string(body))
+	assert.Equal(t, parser.Headers{
+		"Checksum": {"abc"},
+		"Expires":  nil,
+		"X-Extra":  {"1"},
+	}, r.Trailer)
+
+	// The next request starts right after the trailer section
+	next, err := parser.ParseRequest(reader, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "/next", next.URL.Path)
+}
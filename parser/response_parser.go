@@ -4,9 +4,11 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/arthur-teixeira/go-http/textreader"
 	"github.com/arthur-teixeira/go-http/transport"
@@ -25,12 +27,35 @@ type Response struct {
 	Minor          int
 	Version        string
 	request        *Request
+	requestMethod  string
 	Trailer        Headers
 	Chunked        bool
 }
 
-func ParseResponse(src transport.Reusable) (*Response, error) {
-	reader := bufio.NewReader(src)
+// Reports whether a response with the given status code can have a body.
+// See RFC 9110, 6.4.1
+func BodyAllowedForStatus(code int) bool {
+	switch {
+	case code >= 100 && code <= 199:
+		return false
+	case code == 204, code == 304:
+		return false
+	}
+
+	return true
+}
+
+// Parses the response to a request made with method. Responses to HEAD
+// requests never have a body, even when they have a Content-Length.
+func ParseResponse(src transport.Reusable, method string) (*Response, error) {
+	return ParseResponseReader(bufio.NewReader(src), src, method)
+}
+
+// Like ParseResponse, but reads from reader, which buffers src. Several
+// responses read from the same connection, like interim ones followed by
+// the final one, must share the reader, since it may hold the start of the
+// next one.
+func ParseResponseReader(reader *bufio.Reader, src transport.Reusable, method string) (*Response, error) {
 	tr := textreader.NewTextReader(reader)
 	defer textreader.PutTextReader(tr)
 
@@ -65,7 +90,18 @@ func ParseResponse(src transport.Reusable) (*Response, error) {
 	r.Headers = headers
 
 	r.StatusCode = statusCode
+	r.requestMethod = method
 	r.Status = fmt.Sprintf("%d %s", statusCode, reason)
+	r.Close = shouldClose(major, minor, r.Headers)
+	if timeout, max, ok := r.KeepAlive(); ok {
+		// The server won't take another request on this connection
+		r.Close = r.Close || max == 0
+		// Applied before the connection can go back to the pool, which
+		// happens right away for responses without a body
+		if ka, ok := src.(transport.KeepAliver); ok {
+			ka.SetKeepAlive(timeout, max)
+		}
+	}
 	err = setBody(&r, reader, src)
 	if err != nil {
 		return nil, err
@@ -74,6 +110,34 @@ func ParseResponse(src transport.Reusable) (*Response, error) {
 	return &r, nil
 }
 
+// Returns the parameters of the Keep-Alive header, see RFC 2068, 19.7.1.1.
+// timeout is how long the server keeps the connection open while idle, and
+// max how many more requests it accepts on it. max is -1 and timeout 0 when
+// the server didn't say, ok is false if it said neither.
+func (r *Response) KeepAlive() (timeout time.Duration, max int, ok bool) {
+	max = -1
+	for _, v := range r.Headers["Keep-Alive"] {
+		forEachHeaderElement(v, func(param string) {
+			name, value, _ := strings.Cut(param, "=")
+			n, err := strconv.Atoi(strings.Trim(textproto.TrimString(value), `"`))
+			if err != nil || n < 0 {
+				return
+			}
+
+			switch strings.ToLower(textproto.TrimString(name)) {
+			case "timeout":
+				timeout = time.Duration(n) * time.Second
+				ok = true
+			case "max":
+				max = n
+				ok = true
+			}
+		})
+	}
+
+	return timeout, max, ok
+}
+
 func parseStatusLine(line string) (version string, statusCode int, reason string, ok bool) {
 	version, rest, ok1 := strings.Cut(line, " ")
 	status, reason, ok2 := strings.Cut(rest, " ")
@@ -0,0 +1,238 @@
+package parser_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arthur-teixeira/go-http/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+// Stands in for a pooled connection
+type fakeConn struct {
+	io.Reader
+	released bool
+	closed   bool
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) Release() {
+	c.released = true
+}
+
+func newFakeConn(s string) *fakeConn {
+	return &fakeConn{Reader: strings.NewReader(s)}
+}
+
+func TestParseResponse(t *testing.T) {
+	conn := newFakeConn("HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"hello")
+	res, err := parser.ParseResponse(conn, "GET")
+	assert.Nil(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, int64(5), res.ContentLength)
+
+	body, err := io.ReadAll(res.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestParseResponseWithoutBody(t *testing.T) {
+	cases := []struct {
+		method   string
+		response string
+	}{
+		{"HEAD", "HTTP/1.1 200 OK\r\nContent-Length: 1234\r\n\r\n"},
+		{"HEAD", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"},
+		{"GET", "HTTP/1.1 204 No Content\r\nContent-Length: 10\r\n\r\n"},
+		{"GET", "HTTP/1.1 304 Not Modified\r\nContent-Length: 10\r\n\r\n"},
+		{"GET", "HTTP/1.1 103 Early Hints\r\n\r\n"},
+	}
+
+	for _, c := range cases {
+		conn := newFakeConn(c.response)
+		res, err := parser.ParseResponse(conn, c.method)
+		assert.Nil(t, err)
+		assert.Equal(t, parser.NoBody, res.Body, c.response)
+		// Interim responses keep the connection for the final one
+		assert.Equal(t, res.StatusCode/100 != 1, conn.released, c.response)
+	}
+
+	res, _ := parser.ParseResponse(newFakeConn(cases[0].response), "HEAD")
+	assert.Equal(t, int64(1234), res.ContentLength)
+}
+
+func TestParseResponseCloseDelimited(t *testing.T) {
+	conn := newFakeConn("HTTP/1.1 200 OK\r\n" +
+		"\r\n" +
+		"until the connection closes")
+	res, err := parser.ParseResponse(conn, "GET")
+	assert.Nil(t, err)
+	assert.True(t, res.Close)
+	assert.Equal(t, int64(-1), res.ContentLength)
+
+	body, err := io.ReadAll(res.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "until the connection closes", string(body))
+
+	res.Body.Close()
+	assert.True(t, conn.closed)
+	assert.False(t, conn.released)
+
+	// Chunked isn't the final coding, so it's read until close as well
+	conn = newFakeConn("HTTP/1.1 200 OK\r\n" +
+		"Transfer-Encoding: chunked, gzip\r\n" +
+		"Content-Length: 3\r\n" +
+		"\r\n" +
+		"gzipped")
+	res, err = parser.ParseResponse(conn, "GET")
+	assert.Nil(t, err)
+	body, _ = io.ReadAll(res.Body)
+	assert.Equal(t, "gzipped", string(body))
+}
+
+func TestParseResponseConnectionReuse(t *testing.T) {
+	cases := []struct {
+		response string
+		close    bool
+	}{
+		{"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", false},
+		{"HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\n\r\nok", true},
+		{"HTTP/1.1 200 OK\r\nConnection: Keep-Alive, Close\r\nContent-Length: 2\r\n\r\nok", true},
+		{"HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok", true},
+		{"HTTP/1.0 200 OK\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\nok", false},
+		{"HTTP/1.1 200 OK\r\nKeep-Alive: timeout=5, max=0\r\nContent-Length: 2\r\n\r\nok", true},
+		{"HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n", true},
+	}
+
+	for _, c := range cases {
+		conn := newFakeConn(c.response)
+		res, err := parser.ParseResponse(conn, "GET")
+		assert.Nil(t, err)
+		assert.Equal(t, c.close, res.Close, c.response)
+
+		io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, c.close, conn.closed, c.response)
+		assert.Equal(t, !c.close, conn.released, c.response)
+	}
+}
+
+// A pooled connection with a limit on draining bodies
+type drainConn struct {
+	*fakeConn
+	maxBytes int64
+}
+
+func (c drainConn) DrainLimits() (int64, time.Duration) {
+	return c.maxBytes, time.Second
+}
+
+func TestParseResponseBodyNotRead(t *testing.T) {
+	const response = "HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"hello"
+
+	// The rest of the body is read, so the connection can be reused
+	conn := newFakeConn(response)
+	res, err := parser.ParseResponse(conn, "GET")
+	assert.Nil(t, err)
+	buf := make([]byte, 2)
+	res.Body.Read(buf)
+	assert.Nil(t, res.Body.Close())
+	assert.False(t, conn.closed)
+	assert.True(t, conn.released)
+
+	// Closing twice is harmless, reading afterwards fails
+	conn = newFakeConn(response)
+	res, _ = parser.ParseResponse(conn, "GET")
+	assert.Nil(t, res.Body.Close())
+	assert.Nil(t, res.Body.Close())
+	_, err = res.Body.Read(buf)
+	assert.ErrorIs(t, err, parser.ErrBodyReadAfterClose)
+
+	// Too much is left, so the connection isn't worth keeping
+	conn = newFakeConn(response)
+	res, _ = parser.ParseResponse(drainConn{conn, 2}, "GET")
+	res.Body.Read(buf[:1])
+	res.Body.Close()
+	assert.True(t, conn.closed)
+	assert.False(t, conn.released)
+
+	conn = newFakeConn(response)
+	res, _ = parser.ParseResponse(drainConn{conn, -1}, "GET")
+	res.Body.Close()
+	assert.True(t, conn.closed)
+
+	// Reading exactly the declared length is enough
+	conn = newFakeConn(response)
+	res, _ = parser.ParseResponse(drainConn{conn, -1}, "GET")
+	buf = make([]byte, 5)
+	io.ReadFull(res.Body, buf)
+	res.Body.Close()
+	assert.False(t, conn.closed)
+	assert.True(t, conn.released)
+}
+
+// Records the Keep-Alive parameters applied to the connection
+type keepAliveConn struct {
+	*fakeConn
+	timeout        time.Duration
+	max            int
+	releasedBefore bool // Released before the parameters were applied
+}
+
+func (c *keepAliveConn) SetKeepAlive(timeout time.Duration, max int) {
+	c.timeout, c.max = timeout, max
+	c.releasedBefore = c.released
+}
+
+func TestParseResponseAppliesKeepAlive(t *testing.T) {
+	conn := &keepAliveConn{fakeConn: newFakeConn("HTTP/1.1 204 No Content\r\n" +
+		"Keep-Alive: timeout=5, max=10\r\n" +
+		"\r\n")}
+	_, err := parser.ParseResponse(conn, "GET")
+	assert.Nil(t, err)
+	assert.True(t, conn.released)
+
+	// The connection goes back to the pool already knowing the parameters
+	assert.False(t, conn.releasedBefore)
+	assert.Equal(t, 5*time.Second, conn.timeout)
+	assert.Equal(t, 10, conn.max)
+}
+
+func TestResponseKeepAlive(t *testing.T) {
+	cases := []struct {
+		header  string
+		timeout time.Duration
+		max     int
+		ok      bool
+	}{
+		{"", 0, -1, false},
+		{"timeout=5, max=100", 5 * time.Second, 100, true},
+		{"Timeout=\"30\"", 30 * time.Second, -1, true},
+		{"max=3", 0, 3, true},
+		{"timeout=soon, max=-1", 0, -1, false},
+	}
+
+	for _, c := range cases {
+		res := parser.Response{Headers: parser.Headers{}}
+		if c.header != "" {
+			res.Headers.Set("Keep-Alive", c.header)
+		}
+
+		timeout, max, ok := res.KeepAlive()
+		assert.Equal(t, c.timeout, timeout, c.header)
+		assert.Equal(t, c.max, max, c.header)
+		assert.Equal(t, c.ok, ok, c.header)
+	}
+}
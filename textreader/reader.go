@@ -8,10 +8,22 @@ import (
 	"sync"
 )
 
+var (
+	ErrLineTooLong     = errors.New("line too long")
+	ErrHeadersTooLarge = errors.New("headers too large")
+	ErrTooManyHeaders  = errors.New("too many header fields")
+	ErrBareLF          = errors.New("line ending without CR")
+)
+
 var readerPool sync.Pool
 
+// Limits of zero mean no limit
 type TextReader struct {
-	R *bufio.Reader
+	R              *bufio.Reader
+	MaxLineLength  int  // Max length of a line read by ReadLine
+	MaxHeaderBytes int  // Max size of all the header lines read by ReadHeaders
+	MaxHeaderCount int  // Max number of header lines read by ReadHeaders
+	Strict         bool // Only accept lines ending in CRLF
 }
 
 func NewTextReader(rv *bufio.Reader) *TextReader {
@@ -24,29 +36,55 @@ func NewTextReader(rv *bufio.Reader) *TextReader {
 }
 
 func PutTextReader(r *TextReader) {
-	r.R = nil
+	*r = TextReader{}
 	readerPool.Put(r)
 }
 
 func (tr *TextReader) ReadLine() (string, error) {
-	line, err := tr.readLineSlice()
+	line, err := tr.readLineSlice(tr.MaxLineLength)
 	return string(line), err
 }
 
-func (tr *TextReader) readLineSlice() ([]byte, error) {
+// Reads a line without its ending. Lines longer than limit are an error, so
+// that a client can't make the line grow without bound.
+func (tr *TextReader) readLineSlice(limit int) ([]byte, error) {
 	var line []byte
 	for {
-		l, more, err := tr.R.ReadLine()
-		if err != nil {
-			return nil, err
+		l, err := tr.R.ReadSlice('\n')
+		if line == nil && err == nil {
+			line = l
+		} else {
+			line = append(line, l...)
 		}
-		if line == nil && !more {
-			return l, nil
+
+		if err == bufio.ErrBufferFull {
+			// One extra byte for a CR whose LF is still to come
+			if limit > 0 && len(line) > limit+1 {
+				return nil, ErrLineTooLong
+			}
+			continue
 		}
-		line = append(line, l...)
-		if !more {
+
+		if err != nil {
+			// Like bufio.Reader.ReadLine, an unterminated last line is
+			// returned as is
+			if len(line) == 0 || tr.Strict {
+				return nil, err
+			}
 			break
 		}
+
+		line = line[:len(line)-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		} else if tr.Strict {
+			return nil, ErrBareLF
+		}
+		break
+	}
+
+	if limit > 0 && len(line) > limit {
+		return nil, ErrLineTooLong
 	}
 
 	return line, nil
@@ -54,23 +92,37 @@ func (tr *TextReader) readLineSlice() ([]byte, error) {
 
 func (tr *TextReader) ReadHeaders() (map[string][]string, error) {
 	headers := make(map[string][]string)
+	remaining, count := tr.MaxHeaderBytes, 0
 	for {
-		line, err := tr.ReadLine()
+		limit := tr.MaxLineLength
+		if tr.MaxHeaderBytes > 0 && (limit <= 0 || limit > remaining) {
+			limit = max(remaining, 1)
+		}
+
+		line, err := tr.readLineSlice(limit)
+		if errors.Is(err, ErrLineTooLong) {
+			return nil, ErrHeadersTooLarge
+		}
 		if err != nil {
 			return nil, err
 		}
 
-    if line == "" {
-      break
-    }
+		if len(line) == 0 {
+			break
+		}
+
+		remaining -= len(line)
+		if count++; tr.MaxHeaderCount > 0 && count > tr.MaxHeaderCount {
+			return nil, ErrTooManyHeaders
+		}
 
-		key, rest, ok := strings.Cut(line, ":")
+		key, rest, ok := strings.Cut(string(line), ":")
 		if !ok {
 			return nil, errors.New("malformed Header, missing key")
 		}
-    val := strings.TrimSpace(rest)
+		val := strings.TrimSpace(rest)
 		headers[http.CanonicalHeaderKey(key)] = append(headers[http.CanonicalHeaderKey(key)], val)
 	}
 
-  return headers, nil
+	return headers, nil
 }
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package transport
+
+// Peeking at a socket without blocking isn't supported here. Requests on
+// dead connections are retried by the client instead.
+func (c *conn) alive() bool {
+	return true
+}
@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package transport
+
+import "syscall"
+
+// Checks without blocking that the server didn't close the connection, or
+// send something unsolicited, while it sat in the pool.
+func (c *conn) alive() bool {
+	sc, ok := c.sock.(syscall.Conn)
+	if !ok {
+		return true
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	alive := false
+	err = rc.Read(func(fd uintptr) bool {
+		var b [1]byte
+		_, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		// Nothing to read is the only healthy state. Otherwise there's data
+		// or EOF.
+		alive = err == syscall.EAGAIN || err == syscall.EWOULDBLOCK
+		return true
+	})
+
+	return err == nil && alive
+}
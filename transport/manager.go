@@ -2,12 +2,15 @@ package transport
 
 import (
 	"container/list"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,29 +19,131 @@ type Reusable interface {
 	Release()
 }
 
+// Implemented by connections that take the Keep-Alive parameters of the
+// responses received on them into account
+type KeepAliver interface {
+	SetKeepAlive(timeout time.Duration, max int)
+}
+
+// Implemented by connections that bound the reading of the rest of a body
+// closed before its end, which is needed to reuse them
+type Drainer interface {
+	DrainLimits() (maxBytes int64, timeout time.Duration)
+}
+
 type conn struct {
-	id         string     // For testing purposes
+	id         string // For testing purposes
+	manager    *ConnectionManager
 	mu         sync.Mutex // Protects the underlying connection
 	sock       net.Conn
 	targetAddr string
 	idleMu     sync.Mutex // Protects the idle field
 	idle       bool
 	idleSince  time.Time
-	closed     bool
+	createdAt  time.Time
+	reused     bool // Handed out from the pool rather than freshly dialed
+	closed     atomic.Bool
+	// Announced by the server in Keep-Alive, protected by idleMu
+	keepAlive    time.Duration // How long the server keeps the connection idle, 0 if unknown
+	requestsLeft int           // Requests the server still accepts, -1 if unknown
 }
 
 func (c *conn) Close() error {
+	if c.manager == nil {
+		c.closed.Store(true)
+		return c.sock.Close()
+	}
+
+	c.manager.ConnectionMu.Lock()
+	closed := c.manager.removeLocked(c)
+	c.manager.ConnectionMu.Unlock()
+	if !closed {
+		return nil
+	}
+
+	return c.closeSock()
+}
+
+func (c *conn) closeSock() error {
 	fmt.Println("Closed connection ", c.id)
-	c.closed = true
 	return c.sock.Close()
 }
 
+// Returns the connection to the pool, handing it over to the first request
+// waiting for one.
 func (c *conn) Release() {
+	if c.manager == nil || c.closed.Load() {
+		return
+	}
+
+	m := c.manager
+	m.ConnectionMu.Lock()
+	if c.closed.Load() {
+		m.ConnectionMu.Unlock()
+		return
+	}
+
+	if m.shutDown || m.pastLifetime(c, time.Now()) || c.exhausted() {
+		m.removeLocked(c)
+		m.ConnectionMu.Unlock()
+		c.closeSock()
+		return
+	}
+	defer m.ConnectionMu.Unlock()
+
 	fmt.Println("Connection ", c.id, " Released")
 	c.idleMu.Lock()
 	c.idle = true
 	c.idleSince = time.Now()
 	c.idleMu.Unlock()
+	m.wakeWaitersLocked()
+}
+
+// Applies the Keep-Alive parameters of a response received on the
+// connection. A timeout of zero or a negative max leaves the value as is.
+func (c *conn) SetKeepAlive(timeout time.Duration, max int) {
+	c.idleMu.Lock()
+	defer c.idleMu.Unlock()
+
+	if timeout > 0 {
+		c.keepAlive = timeout
+	}
+	if max >= 0 {
+		c.requestsLeft = max
+	}
+}
+
+// Whether the server said it takes no more requests on the connection
+func (c *conn) exhausted() bool {
+	c.idleMu.Lock()
+	defer c.idleMu.Unlock()
+	return c.requestsLeft == 0
+}
+
+// Unread body bytes discarded to keep a connection, for the client pool and
+// the server alike, unless configured otherwise
+const DefaultMaxDrainBytes = 256 << 10
+
+const defaultDrainTimeout = 50 * time.Millisecond
+
+func (c *conn) DrainLimits() (maxBytes int64, timeout time.Duration) {
+	maxBytes, timeout = DefaultMaxDrainBytes, defaultDrainTimeout
+	if m := c.manager; m != nil {
+		if m.MaxDrainBytes != 0 {
+			maxBytes = max(m.MaxDrainBytes, 0)
+		}
+		if m.DrainTimeout > 0 {
+			timeout = m.DrainTimeout
+		}
+	}
+
+	return maxBytes, timeout
+}
+
+// Reports whether the connection served an earlier request. The server
+// may close such a connection right as a new request is sent.
+func (c *conn) Reused() bool {
+	return c.reused
 }
 
 func (c *conn) Read(b []byte) (int, error) {
@@ -49,13 +154,55 @@ func (c *conn) Write(b []byte) (int, error) {
 	return c.sock.Write(b)
 }
 
+func (c *conn) SetReadDeadline(t time.Time) error {
+	return c.sock.SetReadDeadline(t)
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return c.sock.SetWriteDeadline(t)
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.sock.SetDeadline(t)
+}
+
+var ErrManagerClosed = errors.New("connection manager closed")
+
+// Pools connections by host. Once MaxConnections or MaxConnectionsPerHost
+// is reached, getting a connection blocks until one is released or closed.
+// Waiting requests are served in the order they arrived. Limits of zero
+// mean no limit.
+//
+// While connections are pooled, a background goroutine closes the ones idle
+// for longer than IdleTimeout and the ones older than MaxLifetime. It runs
+// until Close is called.
 type ConnectionManager struct {
 	MaxConnections        int // Max connections overall
-	TotalConnections      int // Connection count for all hosts
+	TotalConnections      int // Connection count for all hosts, including the ones being dialed
 	MaxConnectionsPerHost int
 	IdleTimeout           time.Duration
-	ConnectionMu          sync.RWMutex          // Blocks connections for adding/deleting
-	Connections           map[string]*list.List // List of *conn
+	MaxLifetime           time.Duration // Connections aren't reused past this age
+	// Response body left unread when closed that is read to keep the
+	// connection, waiting at most DrainTimeout. Larger or slower leftovers
+	// close the connection. Default to 256KB and 50ms, a negative
+	// MaxDrainBytes always closes.
+	MaxDrainBytes int64
+	DrainTimeout  time.Duration
+	ConnectionMu  sync.RWMutex          // Blocks connections for adding/deleting
+	Connections   map[string]*list.List // List of *conn
+	dialing       map[string]int        // Connections being dialed by host
+	waiters       list.List             // List of *waiter, in arrival order
+	stopReaper    chan struct{}         // Set while the reaper runs
+	shutDown      bool
+}
+
+// A request for a connection blocked by the limits
+type waiter struct {
+	host  string
+	fresh bool // Only a new connection will do
+	// Receives an idle connection, or nil once a new one may be dialed.
+	// Closed when the manager is closed.
+	ready chan *conn
 }
 
 var Manager = ConnectionManager{
@@ -65,33 +212,154 @@ var Manager = ConnectionManager{
 	Connections:           map[string]*list.List{},
 }
 
+// Closes the idle connections past IdleTimeout or MaxLifetime
 func (m *ConnectionManager) ClearIdleConnections() {
-	m.ConnectionMu.Lock()
-	defer m.ConnectionMu.Unlock()
+	now := time.Now()
+	m.closeIdle(func(c *conn) bool {
+		return m.idleExpired(c, now) || m.pastLifetime(c, now)
+	})
+}
+
+// Closes all idle connections. Connections in use are kept.
+func (m *ConnectionManager) CloseIdleConnections() {
+	m.closeIdle(func(*conn) bool { return true })
+}
 
+func (m *ConnectionManager) closeIdle(expired func(c *conn) bool) {
+	m.ConnectionMu.Lock()
+	var closed []*conn
 	for _, conns := range m.Connections {
-		collect := []*list.Element{}
 		for node := conns.Front(); node != nil; node = node.Next() {
 			conn, ok := node.Value.(*conn)
 			if !ok {
 				panic("Item in connection manager is not a valid connection")
 			}
-			if conn.closed {
-				collect = append(collect, node)
-				continue
-			}
 
 			conn.idleMu.Lock()
-			if conn.idle && time.Since(conn.idleSince) >= m.IdleTimeout {
-				conn.Close()
-				collect = append(collect, node)
+			if conn.idle && expired(conn) {
+				closed = append(closed, conn)
 			}
 			conn.idleMu.Unlock()
 		}
-		for _, n := range collect {
-			conns.Remove(n)
+	}
+	for _, conn := range closed {
+		m.removeLocked(conn)
+	}
+	m.ConnectionMu.Unlock()
+
+	for _, conn := range closed {
+		conn.closeSock()
+	}
+}
+
+// Whether c has been idle for longer than IdleTimeout, or than the server
+// keeps it open if that's shorter. Must be called with c.idleMu held.
+func (m *ConnectionManager) idleExpired(c *conn, now time.Time) bool {
+	timeout := m.IdleTimeout
+	if c.keepAlive > 0 && (timeout <= 0 || c.keepAlive < timeout) {
+		timeout = c.keepAlive
+	}
+
+	return timeout > 0 && now.Sub(c.idleSince) >= timeout
+}
+
+func (m *ConnectionManager) pastLifetime(c *conn, now time.Time) bool {
+	return m.MaxLifetime > 0 && now.Sub(c.createdAt) >= m.MaxLifetime
+}
+
+// Stops the reaper and closes every pooled connection, including the ones
+// in use. Waiting and later requests for a connection fail with
+// ErrManagerClosed.
+func (m *ConnectionManager) Close() error {
+	m.ConnectionMu.Lock()
+	m.shutDown = true
+	if m.stopReaper != nil {
+		close(m.stopReaper)
+		m.stopReaper = nil
+	}
+
+	for node := m.waiters.Front(); node != nil; node = node.Next() {
+		close(node.Value.(*waiter).ready)
+	}
+	m.waiters.Init()
+
+	var all []*conn
+	for _, conns := range m.Connections {
+		for node := conns.Front(); node != nil; node = node.Next() {
+			all = append(all, node.Value.(*conn))
+		}
+	}
+	for _, conn := range all {
+		m.detachLocked(conn)
+	}
+	m.ConnectionMu.Unlock()
+
+	for _, conn := range all {
+		conn.closeSock()
+	}
+
+	return nil
+}
+
+// Starts the reaper once there are timeouts to enforce
+func (m *ConnectionManager) startReaperLocked() {
+	if m.stopReaper != nil || m.shutDown {
+		return
+	}
+
+	d := m.IdleTimeout
+	if d <= 0 || (m.MaxLifetime > 0 && m.MaxLifetime < d) {
+		d = m.MaxLifetime
+	}
+	if d <= 0 {
+		return
+	}
+
+	m.stopReaper = make(chan struct{})
+	go m.reap(m.stopReaper, max(d/2, 10*time.Millisecond))
+}
+
+func (m *ConnectionManager) reap(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.ClearIdleConnections()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Takes a closed connection out of the pool, making room for a new one.
+// Reports whether c was still open.
+func (m *ConnectionManager) removeLocked(c *conn) bool {
+	if !m.detachLocked(c) {
+		return false
+	}
+
+	m.wakeWaitersLocked()
+	return true
+}
+
+// Marks c as closed and forgets about it, without waking waiters
+func (m *ConnectionManager) detachLocked(c *conn) bool {
+	if !c.closed.CompareAndSwap(false, true) {
+		return false
+	}
+
+	if conns := m.Connections[c.targetAddr]; conns != nil {
+		for node := conns.Front(); node != nil; node = node.Next() {
+			if node.Value == c {
+				conns.Remove(node)
+				break
+			}
 		}
 	}
+	m.TotalConnections--
+	return true
 }
 
 func randId() string {
@@ -102,76 +370,237 @@ func randId() string {
 	return hex.EncodeToString(bytes)
 }
 
-func (m *ConnectionManager) dial(host string) (*conn, error) {
+func (m *ConnectionManager) dial(ctx context.Context, host string) (*conn, error) {
 	fmt.Println("Dialing host")
-	netConn, err := net.Dial("tcp", host)
+	var d net.Dialer
+	netConn, err := d.DialContext(ctx, "tcp", host)
 	if err != nil {
 		return nil, err
 	}
 
 	return &conn{
-		id:         randId(),
-		targetAddr: host,
-		sock:       netConn,
-		idle:       false,
+		id:           randId(),
+		manager:      m,
+		createdAt:    time.Now(),
+		targetAddr:   host,
+		sock:         netConn,
+		idle:         false,
+		requestsLeft: -1,
 	}, nil
 }
 
-func (m *ConnectionManager) findConnection(conns *list.List) *conn {
-	for node := conns.Front(); node != nil; node = node.Next() {
+// Takes an idle connection from conns. Connections that the server closed
+// or that are past MaxLifetime are skipped, the former are closed, as are
+// the ones idle for longer than the server keeps them.
+func (m *ConnectionManager) findConnection(conns *list.List, now time.Time) *conn {
+	if conns == nil {
+		return nil
+	}
+
+	for node := conns.Front(); node != nil; {
+		next := node.Next()
 		conn, ok := node.Value.(*conn)
 		if !ok {
 			panic("Item in connection manager is not a valid connection")
 		}
+		node = next
 
 		conn.idleMu.Lock()
-		if conn.idle {
-      fmt.Printf("Found idle connection %s, reusing\n", conn.id)
-			conn.idle = false
+		if !conn.idle || conn.closed.Load() || m.pastLifetime(conn, now) {
+			conn.idleMu.Unlock()
+			continue
+		}
+
+		if m.idleExpired(conn, now) || !conn.alive() {
 			conn.idleMu.Unlock()
-			return conn
+			m.detachLocked(conn)
+			conn.closeSock()
+			continue
+		}
+
+		fmt.Printf("Found idle connection %s, reusing\n", conn.id)
+		conn.idle = false
+		conn.reused = true
+		if conn.requestsLeft > 0 {
+			conn.requestsLeft--
 		}
 		conn.idleMu.Unlock()
+		return conn
 	}
 
 	return nil
 }
 
 func (m *ConnectionManager) GetConnection(host string) (*conn, error) {
+	return m.GetConnectionContext(context.Background(), host)
+}
+
+// Returns an idle connection to host, or dials a new one. When the limits
+// are reached, waits for a connection to be released or closed until ctx
+// is done.
+func (m *ConnectionManager) GetConnectionContext(ctx context.Context, host string) (*conn, error) {
+	return m.getConnection(ctx, host, false)
+}
+
+// Like GetConnectionContext, but always dials a new connection. Idle ones
+// to host are closed when needed to stay within the limits.
+func (m *ConnectionManager) NewConnectionContext(ctx context.Context, host string) (*conn, error) {
+	return m.getConnection(ctx, host, true)
+}
+
+func (m *ConnectionManager) getConnection(ctx context.Context, host string, fresh bool) (*conn, error) {
 	m.ConnectionMu.Lock()
+	if m.shutDown {
+		m.ConnectionMu.Unlock()
+		return nil, ErrManagerClosed
+	}
+	m.startReaperLocked()
+
+	if conn, ok := m.acquireLocked(host, fresh); ok {
+		m.ConnectionMu.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		return m.dialReserved(ctx, host)
+	}
+
+	w := &waiter{host: host, fresh: fresh, ready: make(chan *conn, 1)}
+	elem := m.waiters.PushBack(w)
+	m.ConnectionMu.Unlock()
+
+	select {
+	case conn, ok := <-w.ready:
+		if !ok {
+			return nil, ErrManagerClosed
+		}
+		if conn != nil {
+			return conn, nil
+		}
+		return m.dialReserved(ctx, host)
+	case <-ctx.Done():
+		m.ConnectionMu.Lock()
+		m.waiters.Remove(elem)
+		m.ConnectionMu.Unlock()
+
+		// Got a connection or a slot right before giving up
+		select {
+		case conn, ok := <-w.ready:
+			if conn != nil {
+				conn.Release()
+			} else if ok {
+				m.unreserve(host)
+			}
+		default:
+		}
+
+		return nil, ctx.Err()
+	}
+}
+
+// Takes an idle connection to host unless fresh is set, or reserves room to
+// dial a new one, in which case the connection is nil. Reports false if the
+// limits don't allow either.
+func (m *ConnectionManager) acquireLocked(host string, fresh bool) (*conn, bool) {
+	if m.Connections == nil {
+		m.Connections = map[string]*list.List{}
+	}
+	if m.dialing == nil {
+		m.dialing = map[string]int{}
+	}
+
 	conns := m.Connections[host]
 	if conns == nil {
 		conns = list.New()
 		m.Connections[host] = conns
 	}
-	m.ConnectionMu.Unlock()
 
-	conn := m.findConnection(conns)
-	if conn != nil {
-		return conn, nil
+	if !fresh {
+		if conn := m.findConnection(conns, time.Now()); conn != nil {
+			return conn, true
+		}
 	}
 
-	// TODO: if MaxConnections is reached, wait until another connection is dropped
+	if m.MaxConnectionsPerHost > 0 && conns.Len()+m.dialing[host] >= m.MaxConnectionsPerHost &&
+		!(fresh && m.closeIdleLocked(host)) {
+		return nil, false
+	}
 
-	// TODO: if MaxSimultaneousConnections is reached for this host,
-	// wait until an existing connection is released or closed.
-	// If closed, create new one. If released, reuse.
+	if m.MaxConnections > 0 && m.TotalConnections >= m.MaxConnections && !m.closeIdleLocked("") {
+		return nil, false
+	}
 
-	m.ConnectionMu.Lock()
-	defer m.ConnectionMu.Unlock()
+	m.TotalConnections++
+	m.dialing[host]++
+	return nil, true
+}
+
+// Closes the connection to host that has been idle the longest, or to any
+// host if host is empty. Reports whether there was one.
+func (m *ConnectionManager) closeIdleLocked(host string) bool {
+	var oldest *conn
+	for addr, conns := range m.Connections {
+		if host != "" && addr != host {
+			continue
+		}
+
+		for node := conns.Front(); node != nil; node = node.Next() {
+			conn := node.Value.(*conn)
+			conn.idleMu.Lock()
+			if conn.idle && (oldest == nil || conn.idleSince.Before(oldest.idleSince)) {
+				oldest = conn
+			}
+			conn.idleMu.Unlock()
+		}
+	}
 
-	// Try to find connection creating after releasing read lock
-	conn = m.findConnection(conns)
-	if conn != nil {
-		return conn, nil
+	if oldest == nil {
+		return false
 	}
 
-	// No available connection, creating new one
-	newConn, err := m.dial(host)
+	// Not through removeLocked, as the room is for the caller rather than
+	// the waiters
+	m.detachLocked(oldest)
+	oldest.closeSock()
+	return true
+}
+
+// Hands released connections and freed room to waiters, in arrival order
+func (m *ConnectionManager) wakeWaitersLocked() {
+	for node := m.waiters.Front(); node != nil; {
+		next := node.Next()
+		w := node.Value.(*waiter)
+		if conn, ok := m.acquireLocked(w.host, w.fresh); ok {
+			m.waiters.Remove(node)
+			w.ready <- conn
+		}
+		node = next
+	}
+}
+
+func (m *ConnectionManager) dialReserved(ctx context.Context, host string) (*conn, error) {
+	newConn, err := m.dial(ctx, host)
+
+	m.ConnectionMu.Lock()
+	defer m.ConnectionMu.Unlock()
+	m.dialing[host]--
+	if err == nil && m.shutDown {
+		newConn.sock.Close()
+		err = ErrManagerClosed
+	}
 	if err != nil {
+		m.TotalConnections--
+		m.wakeWaitersLocked()
 		return nil, err
 	}
-	m.TotalConnections += 1
+
 	m.Connections[host].PushFront(newConn)
 	return newConn, nil
 }
+
+func (m *ConnectionManager) unreserve(host string) {
+	m.ConnectionMu.Lock()
+	defer m.ConnectionMu.Unlock()
+	m.dialing[host]--
+	m.TotalConnections--
+	m.wakeWaitersLocked()
+}
@@ -0,0 +1,211 @@
+package transport_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/arthur-teixeira/go-http/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func listen(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestConnectionLimits(t *testing.T) {
+	addr := listen(t)
+	m := &transport.ConnectionManager{MaxConnectionsPerHost: 1}
+
+	first, err := m.GetConnection(addr)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, total(m))
+
+	// Gives up once the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = m.GetConnectionContext(ctx, addr)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Waiters get the connection in the order they arrived
+	order := make(chan int, 2)
+	for i := range 2 {
+		go func() {
+			conn, err := m.GetConnection(addr)
+			assert.Nil(t, err)
+			order <- i
+			time.Sleep(10 * time.Millisecond)
+			conn.Release()
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	first.Release()
+	assert.Equal(t, 0, <-order)
+	assert.Equal(t, 1, <-order)
+	assert.Equal(t, 1, total(m))
+
+	// Closing makes room for a new connection
+	conn, err := m.GetConnection(addr)
+	assert.Nil(t, err)
+	conn.Close()
+	conn.Close()
+	assert.Equal(t, 0, total(m))
+
+	conn, err = m.GetConnection(addr)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, total(m))
+	conn.Close()
+}
+
+func TestMaxConnections(t *testing.T) {
+	a, b := listen(t), listen(t)
+	m := &transport.ConnectionManager{MaxConnections: 1}
+
+	conn, err := m.GetConnection(a)
+	assert.Nil(t, err)
+
+	got := make(chan struct{})
+	go func() {
+		other, err := m.GetConnection(b)
+		assert.Nil(t, err)
+		other.Close()
+		close(got)
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("went over MaxConnections")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The idle connection to the other host is closed to make room
+	conn.Release()
+	<-got
+	assert.Equal(t, 0, total(m))
+}
+
+// Reads TotalConnections once the manager is done with it
+func total(m *transport.ConnectionManager) int {
+	m.ConnectionMu.Lock()
+	defer m.ConnectionMu.Unlock()
+	return m.TotalConnections
+}
+
+func TestIdleReaper(t *testing.T) {
+	addr := listen(t)
+	m := &transport.ConnectionManager{IdleTimeout: 50 * time.Millisecond}
+	defer m.Close()
+
+	idle, err := m.GetConnection(addr)
+	assert.Nil(t, err)
+	busy, err := m.GetConnection(addr)
+	assert.Nil(t, err)
+	idle.Release()
+
+	assert.Eventually(t, func() bool { return total(m) == 1 }, time.Second, 10*time.Millisecond)
+	busy.Release()
+	assert.Eventually(t, func() bool { return total(m) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestMaxLifetime(t *testing.T) {
+	addr := listen(t)
+	m := &transport.ConnectionManager{MaxLifetime: 50 * time.Millisecond}
+	defer m.Close()
+
+	conn, err := m.GetConnection(addr)
+	assert.Nil(t, err)
+	time.Sleep(60 * time.Millisecond)
+
+	// Too old to go back to the pool
+	conn.Release()
+	assert.Equal(t, 0, total(m))
+}
+
+func TestManagerClose(t *testing.T) {
+	addr := listen(t)
+	m := &transport.ConnectionManager{MaxConnectionsPerHost: 1}
+
+	busy, err := m.GetConnection(addr)
+	assert.Nil(t, err)
+
+	waiting := make(chan error)
+	go func() {
+		_, err := m.GetConnection(addr)
+		waiting <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Nil(t, m.Close())
+	assert.ErrorIs(t, <-waiting, transport.ErrManagerClosed)
+	assert.Equal(t, 0, total(m))
+
+	// The connection in use was closed too
+	_, err = busy.Write([]byte("x"))
+	assert.NotNil(t, err)
+
+	_, err = m.GetConnection(addr)
+	assert.ErrorIs(t, err, transport.ErrManagerClosed)
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	addr := listen(t)
+	m := &transport.ConnectionManager{}
+	defer m.Close()
+
+	idle, _ := m.GetConnection(addr)
+	busy, _ := m.GetConnection(addr)
+	idle.Release()
+
+	m.CloseIdleConnections()
+	assert.Equal(t, 1, total(m))
+	busy.Close()
+}
+
+func TestKeepAliveHints(t *testing.T) {
+	addr := listen(t)
+	m := &transport.ConnectionManager{}
+	defer m.Close()
+
+	// The server takes one more request
+	conn, err := m.GetConnection(addr)
+	assert.Nil(t, err)
+	conn.SetKeepAlive(0, 1)
+	conn.Release()
+
+	reused, err := m.GetConnection(addr)
+	assert.Nil(t, err)
+	assert.True(t, reused.Reused())
+	reused.Release()
+	assert.Equal(t, 0, total(m))
+
+	// The server closes it before our own idle timeout
+	conn, err = m.GetConnection(addr)
+	assert.Nil(t, err)
+	conn.SetKeepAlive(50*time.Millisecond, -1)
+	conn.Release()
+	time.Sleep(60 * time.Millisecond)
+
+	fresh, err := m.GetConnection(addr)
+	assert.Nil(t, err)
+	assert.False(t, fresh.Reused())
+	assert.Equal(t, 1, total(m))
+	fresh.Close()
+}